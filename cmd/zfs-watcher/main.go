@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -14,21 +15,34 @@ import (
 )
 
 var (
-	pools          []string
-	interval       int
-	outputFile     string
-	outputToFile   bool
-	outputToStdout bool
-	zpoolCommand   string
+	pools           []string
+	interval        int
+	outputFile      string
+	outputToFile    bool
+	outputToStdout  bool
+	zpoolCommand    string
+	naming          string
+	expandRecursive bool
+	listDescendants bool
+	internalEvents  bool
+	longFormat      bool
+	nativeEvents    bool
+	eventSocket     string
+	zedletSocket    string
+	reconcile       int
+	gapThreshold    int
 )
 
+// defaultSocket is where zfs-watcher zedlet forwards events by default
+const defaultSocket = "/run/zfs-watcher.sock"
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "zfs-watcher",
 		Short: "Monitor ZFS events by watching pool history",
 		Long: `A utility that monitors ZFS events by watching the zpool history command.
 This tool will detect volume creation, snapshot creation, volume deletion, 
-snapshot deletion, and volume resize events.`,
+snapshot deletion, volume resize, and filesystem creation and deletion events.`,
 		Run: run,
 	}
 
@@ -43,6 +57,30 @@ default: use system PATH
 /sbin/zpool: alternative Linux location
 /usr/local/sbin/zpool: FreeBSD location
 Or provide a custom path`)
+	rootCmd.Flags().StringVarP(&naming, "naming", "n", "path",
+		`Naming scheme for volume and snapshot IDs. Options:
+path: dataset path below the pool, every dataset is reported
+cinder: only report Cinder volume-<uuid>_<n> volumes and snapshot-<uuid> snapshots`)
+	rootCmd.Flags().BoolVar(&expandRecursive, "expand-recursive", false, "Report each descendant affected by zfs snapshot -r and zfs destroy -r/-R")
+	rootCmd.Flags().BoolVar(&internalEvents, "internal", false, "Read internal events with zpool history -i, reporting changes no user command explains")
+	rootCmd.Flags().BoolVar(&longFormat, "long", false, "Read history with zpool history -l, reporting the user, host and zone of each command")
+	rootCmd.Flags().BoolVar(&nativeEvents, "zpool-events", false, "Also follow zpool events -f, reporting checksum and I/O errors, vdev state changes, resilvers and finished scrubs")
+	rootCmd.Flags().BoolVar(&listDescendants, "list-descendants", false, "Look up descendants with zfs list when expanding recursive snapshots")
+	rootCmd.Flags().IntVar(&reconcile, "reconcile", 0, "Compare zfs list snapshots of the datasets every this many seconds, reporting changes history missed (0: never)")
+	rootCmd.Flags().IntVar(&gapThreshold, "gap-threshold", 0, "Report a history gap when new history records start more than this many seconds after the last one read (0: never)")
+	rootCmd.Flags().StringVar(&eventSocket, "socket", "", "Accept events forwarded by zfs-watcher zedlet on this Unix socket (e.g. "+defaultSocket+")")
+
+	zedletCmd := &cobra.Command{
+		Use:   "zedlet",
+		Short: "Forward the event ZED runs this zedlet for to a running watcher",
+		Long: `Run by the ZFS Event Daemon as a zedlet, e.g. from /etc/zfs/zed.d/all-zfs-watcher.sh.
+Converts the ZEVENT_* environment into an event and forwards it to the
+watcher listening on --socket, which reports it to its handlers.`,
+		Args: cobra.NoArgs,
+		Run:  zedlet,
+	}
+	zedletCmd.Flags().StringVar(&zedletSocket, "socket", defaultSocket, "Unix socket of the running watcher")
+	rootCmd.AddCommand(zedletCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -65,8 +103,17 @@ func run(cmd *cobra.Command, args []string) {
 
 	// Configure the watcher
 	cfg := watcher.Config{
-		Pools:    pools,
-		Interval: time.Duration(interval) * time.Second,
+		Pools:           pools,
+		Interval:        time.Duration(interval) * time.Second,
+		ExpandRecursive: expandRecursive,
+		ListDescendants: listDescendants,
+		InternalEvents:  internalEvents,
+		LongFormat:      longFormat,
+		NativeEvents:    nativeEvents,
+		EventSocket:     eventSocket,
+
+		ReconcileInterval: time.Duration(reconcile) * time.Second,
+		GapThreshold:      time.Duration(gapThreshold) * time.Second,
 	}
 
 	// Set the zpool command path based on flag value
@@ -84,6 +131,17 @@ func run(cmd *cobra.Command, args []string) {
 		cfg.ZpoolCmd = watcher.ZpoolCommand(zpoolCommand)
 	}
 
+	// Set the naming scheme based on flag value
+	switch naming {
+	case "path":
+		cfg.Naming = watcher.PathNaming{}
+	case "cinder":
+		cfg.Naming = watcher.CinderNaming()
+	default:
+		fmt.Printf("Unknown naming scheme: %s\n", naming)
+		os.Exit(1)
+	}
+
 	// Create and set up watcher
 	w := watcher.New(cfg)
 
@@ -95,39 +153,43 @@ func run(cmd *cobra.Command, args []string) {
 		w.AddEventHandler(fileOutputHandler(outputFile))
 	}
 
-	// Handle interrupt signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Start the watcher in a goroutine
-	go w.Start()
+	// Stop the watcher on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	fmt.Printf("ZFS watcher started. Monitoring pools: %s\n", strings.Join(pools, ", "))
 	fmt.Println("Press Ctrl+C to exit.")
 
-	// Wait for SIGINT or SIGTERM
-	<-sigChan
+	// Run the watcher until we receive a signal
+	if err := w.Run(ctx); err != nil {
+		fmt.Printf("Error running watcher: %v\n", err)
+		os.Exit(1)
+	}
 	fmt.Println("\nShutting down...")
 }
 
+// zedlet forwards the event ZED ran it for, passed in the environment, to
+// the watcher listening on zedletSocket
+func zedlet(cmd *cobra.Command, args []string) {
+	event, err := watcher.ZedEvent(os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := watcher.SendEvent(ctx, zedletSocket, event); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // fileOutputHandler returns an event handler that writes events to a file
 func fileOutputHandler(filepath string) watcher.EventHandler {
 	return func(event models.ZFSEvent) {
-		timeStr := event.Timestamp.Format("2006-01-02 15:04:05")
-		var line string
-
-		switch event.Type {
-		case models.EventVolumeCreated:
-			line = fmt.Sprintf("[%s] Volume created: %s on pool %s\n", timeStr, event.Target, event.Pool)
-		case models.EventVolumeDeleted:
-			line = fmt.Sprintf("[%s] Volume deleted: %s on pool %s\n", timeStr, event.Target, event.Pool)
-		case models.EventSnapshotCreated:
-			line = fmt.Sprintf("[%s] Snapshot created: %s on pool %s\n", timeStr, event.Target, event.Pool)
-		case models.EventSnapshotDeleted:
-			line = fmt.Sprintf("[%s] Snapshot deleted: %s on pool %s\n", timeStr, event.Target, event.Pool)
-		case models.EventVolumeResized:
-			line = fmt.Sprintf("[%s] Volume resized: %s to %sKB on pool %s\n", timeStr, event.Target, event.Size, event.Pool)
-		}
+		line := watcher.FormatEvent(event) + "\n"
 
 		// Append the line to the file
 		f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -77,14 +78,13 @@ func main() {
 	})
 
 	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Start the watcher in a goroutine
-	go w.Start()
-
-	// Block until we receive a signal
-	<-sigChan
+	// Run the watcher until we receive a signal
+	if err := w.Run(ctx); err != nil {
+		fmt.Printf("Error running watcher: %v\n", err)
+	}
 	fmt.Println("\nShutting down...")
 
 	// Save the final runtime before exit
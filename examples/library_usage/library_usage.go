@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -59,14 +60,16 @@ func exampleRealTimeMonitoring() {
 	// Add the standard logging handler
 	w.AddEventHandler(watcher.LoggingHandler())
 
-	// Start the watcher in a goroutine
-	go w.Start()
-
 	fmt.Println("Watching for ZFS events in real-time...")
-	fmt.Println("This would normally run indefinitely, but for the example we'll sleep for a few seconds.")
+	fmt.Println("This would normally run until cancelled, but for the example we'll stop after a few seconds.")
+
+	// Run the watcher for a few seconds (would normally run until shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	// Sleep for a few seconds to simulate running (would normally run indefinitely)
-	time.Sleep(3 * time.Second)
+	if err := w.Run(ctx); err != nil {
+		fmt.Printf("Watcher failed: %v\n", err)
+	}
 }
 
 // exampleGetRecentEvents demonstrates how to get events from the last few minutes
@@ -182,11 +185,13 @@ func exampleMonitoringSinceTime() {
 
 	fmt.Printf("Watching for ZFS events since %s...\n",
 		sinceTime.Format("2006-01-02 15:04:05"))
-	fmt.Println("This would normally run indefinitely, but for the example we'll just sleep for a few seconds.")
+	fmt.Println("This would normally run until cancelled, but for the example we'll stop after a few seconds.")
 
-	// Start the watcher in a goroutine
-	go w.Start()
+	// Run the watcher for a few seconds (would normally run until shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	// Sleep for a few seconds to simulate running (would normally run indefinitely)
-	time.Sleep(3 * time.Second)
+	if err := w.Run(ctx); err != nil {
+		fmt.Printf("Watcher failed: %v\n", err)
+	}
 }
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/zfscmd"
 )
 
 // EventType represents the type of ZFS event
@@ -22,31 +24,425 @@ const (
 
 	// EventVolumeResized represents a volume resize event
 	EventVolumeResized EventType = "VOLUME_RESIZED"
+
+	// EventFilesystemCreated represents a filesystem creation event
+	EventFilesystemCreated EventType = "FILESYSTEM_CREATED"
+
+	// EventFilesystemDeleted represents a filesystem deletion event
+	EventFilesystemDeleted EventType = "FILESYSTEM_DELETED"
+
+	// EventCloneCreated represents the creation of a clone from a snapshot
+	EventCloneCreated EventType = "CLONE_CREATED"
+
+	// EventClonePromoted represents the promotion of a clone
+	EventClonePromoted EventType = "CLONE_PROMOTED"
+
+	// EventDatasetRenamed represents a volume or filesystem rename event
+	EventDatasetRenamed EventType = "DATASET_RENAMED"
+
+	// EventSnapshotRenamed represents a snapshot rename event
+	EventSnapshotRenamed EventType = "SNAPSHOT_RENAMED"
+
+	// EventVolumeRolledBack represents the rollback of a volume or
+	// filesystem to a snapshot
+	EventVolumeRolledBack EventType = "VOLUME_ROLLED_BACK"
+
+	// EventBookmarkCreated represents a bookmark creation event
+	EventBookmarkCreated EventType = "BOOKMARK_CREATED"
+
+	// EventBookmarkDeleted represents a bookmark deletion event
+	EventBookmarkDeleted EventType = "BOOKMARK_DELETED"
+
+	// EventSnapshotHeld represents a hold placed on a snapshot
+	EventSnapshotHeld EventType = "SNAPSHOT_HELD"
+
+	// EventSnapshotReleased represents a hold released from a snapshot
+	EventSnapshotReleased EventType = "SNAPSHOT_RELEASED"
+
+	// EventReceived represents a replication stream received with zfs
+	// receive
+	EventReceived EventType = "RECEIVED"
+
+	// EventPoolScrubStarted represents the start of a scrub with zpool
+	// scrub, or the resumption of a paused one
+	EventPoolScrubStarted EventType = "POOL_SCRUB_STARTED"
+
+	// EventPoolScrubPaused represents a scrub paused with zpool scrub -p
+	EventPoolScrubPaused EventType = "POOL_SCRUB_PAUSED"
+
+	// EventPoolScrubStopped represents a scrub stopped with zpool scrub -s
+	EventPoolScrubStopped EventType = "POOL_SCRUB_STOPPED"
+
+	// EventPoolTrimStarted represents the start of a trim with zpool trim
+	EventPoolTrimStarted EventType = "POOL_TRIM_STARTED"
+
+	// EventPoolTrimSuspended represents a trim suspended with zpool trim -s
+	EventPoolTrimSuspended EventType = "POOL_TRIM_SUSPENDED"
+
+	// EventPoolTrimCancelled represents a trim cancelled with zpool trim -c
+	EventPoolTrimCancelled EventType = "POOL_TRIM_CANCELLED"
+
+	// EventPoolVdevAdded represents vdevs added to a pool with zpool add
+	EventPoolVdevAdded EventType = "POOL_VDEV_ADDED"
+
+	// EventPoolDeviceAttached represents a device attached with zpool attach
+	EventPoolDeviceAttached EventType = "POOL_DEVICE_ATTACHED"
+
+	// EventPoolDeviceDetached represents a device detached with zpool detach
+	EventPoolDeviceDetached EventType = "POOL_DEVICE_DETACHED"
+
+	// EventPoolDeviceReplaced represents a device replaced with zpool
+	// replace
+	EventPoolDeviceReplaced EventType = "POOL_DEVICE_REPLACED"
+
+	// EventPoolDeviceOnline represents devices brought online with zpool
+	// online
+	EventPoolDeviceOnline EventType = "POOL_DEVICE_ONLINE"
+
+	// EventPoolDeviceOffline represents devices taken offline with zpool
+	// offline
+	EventPoolDeviceOffline EventType = "POOL_DEVICE_OFFLINE"
+
+	// EventPoolImported represents the import of a pool
+	EventPoolImported EventType = "POOL_IMPORTED"
+
+	// EventPoolExported represents the export of a pool
+	EventPoolExported EventType = "POOL_EXPORTED"
+
+	// EventPoolUpgraded represents a pool upgraded with zpool upgrade
+	EventPoolUpgraded EventType = "POOL_UPGRADED"
+
+	// EventPoolCleared represents device errors cleared with zpool clear
+	EventPoolCleared EventType = "POOL_CLEARED"
+
+	// EventKeyLoaded represents an encryption key loaded with zfs load-key
+	EventKeyLoaded EventType = "KEY_LOADED"
+
+	// EventKeyUnloaded represents an encryption key unloaded with zfs
+	// unload-key
+	EventKeyUnloaded EventType = "KEY_UNLOADED"
+
+	// EventKeyChanged represents an encryption key changed with zfs
+	// change-key
+	EventKeyChanged EventType = "KEY_CHANGED"
+
+	// EventChannelProgramRun represents a channel program run with zfs
+	// program
+	EventChannelProgramRun EventType = "CHANNEL_PROGRAM_RUN"
+
+	// EventPropertySet represents properties set with zfs set
+	EventPropertySet EventType = "PROPERTY_SET"
+
+	// EventPropertyInherited represents properties reverted to their
+	// inherited value with zfs inherit
+	EventPropertyInherited EventType = "PROPERTY_INHERITED"
+
+	// EventChecksumError represents a checksum error reported by a vdev
+	// (ereport.fs.zfs.checksum)
+	EventChecksumError EventType = "CHECKSUM_ERROR"
+
+	// EventIOError represents a failed read or write (ereport.fs.zfs.io)
+	EventIOError EventType = "IO_ERROR"
+
+	// EventDataError represents data that could not be repaired
+	// (ereport.fs.zfs.data)
+	EventDataError EventType = "DATA_ERROR"
+
+	// EventIODelay represents an I/O that took unusually long to complete
+	// (ereport.fs.zfs.delay)
+	EventIODelay EventType = "IO_DELAY"
+
+	// EventDeadman represents I/O or a txg sync that stalled for longer
+	// than the deadman timeout (ereport.fs.zfs.deadman)
+	EventDeadman EventType = "DEADMAN"
+
+	// EventVdevStateChanged represents a vdev changing state, e.g. becoming
+	// FAULTED or DEGRADED (resource.fs.zfs.statechange)
+	EventVdevStateChanged EventType = "VDEV_STATE_CHANGED"
+
+	// EventResilverStarted represents the start of a resilver
+	// (sysevent.fs.zfs.resilver_start)
+	EventResilverStarted EventType = "RESILVER_STARTED"
+
+	// EventResilverFinished represents the end of a resilver
+	// (sysevent.fs.zfs.resilver_finish)
+	EventResilverFinished EventType = "RESILVER_FINISHED"
+
+	// EventScrubFinished represents the end of a scrub
+	// (sysevent.fs.zfs.scrub_finish)
+	EventScrubFinished EventType = "SCRUB_FINISHED"
+
+	// EventHistoryGap warns that pool history records may have been
+	// dropped from the on-disk ring before the watcher read them, see
+	// ZFSEvent.Gap. Changes in the gap may not have been reported.
+	EventHistoryGap EventType = "HISTORY_GAP"
+
+	// EventNative represents any other event of the ZFS event queue, see
+	// NativeEvent.Class
+	EventNative EventType = "NATIVE_EVENT"
 )
 
+// EventSource is what an event was derived from, other than a command in
+// pool history
+type EventSource string
+
+const (
+	// SourceChannelProgram marks events synthesized from the internal
+	// records a channel program wrote
+	SourceChannelProgram EventSource = "channel-program"
+
+	// SourceZpoolEvents marks events read from the event queue of the
+	// kernel module with zpool events
+	SourceZpoolEvents EventSource = "zpool-events"
+
+	// SourceZed marks events the ZFS Event Daemon passed to zfs-watcher
+	// zedlet, which forwarded them to the watcher
+	SourceZed EventSource = "zed"
+
+	// SourceReconcile marks events synthesized by comparing zfs list
+	// snapshots of the dataset tree, for changes history did not explain
+	SourceReconcile EventSource = "reconcile"
+)
+
+// StreamType is the type of a replication stream
+type StreamType string
+
+const (
+	// StreamFull is a full stream, creating or replacing the dataset
+	StreamFull StreamType = "FULL"
+
+	// StreamIncremental is an incremental stream, applied on top of an
+	// existing snapshot of the dataset
+	StreamIncremental StreamType = "INCREMENTAL"
+)
+
+// ReceiveInfo describes a zfs receive
+type ReceiveInfo struct {
+	// Stream is the type of the stream received, or "" if pool history
+	// does not tell
+	Stream StreamType
+
+	// Force is set if the target was rolled back or replaced as needed to
+	// receive the stream (-F)
+	Force bool
+
+	// NoMount is set if the received file system was not mounted (-u)
+	NoMount bool
+
+	// Resumable is set if an interrupted receive can be resumed (-s)
+	Resumable bool
+
+	// NameFromStream is set if the target is the parent of the received
+	// dataset, which is named after the sent one (-d or -e)
+	NameFromStream bool
+
+	// Excluded are the properties excluded from the stream (-x)
+	Excluded []string
+}
+
+// EncryptionInfo describes the encryption parameters given to a command.
+// Key material never appears on the command line and is not recorded.
+type EncryptionInfo struct {
+	// Algorithm is the encryption property, e.g. "aes-256-gcm" or "on"
+	Algorithm string
+
+	// KeyFormat is the keyformat property: "raw", "hex" or "passphrase"
+	KeyFormat string
+
+	// KeyLocation is the keylocation property, "prompt" or a URI
+	KeyLocation string
+
+	// PBKDF2Iterations is the pbkdf2iters property
+	PBKDF2Iterations string
+
+	// Inherited is set if zfs change-key -i made the dataset inherit the
+	// key of its parent
+	Inherited bool
+}
+
+// HistoryGap is a time window of pool history that may have been dropped
+// before it was read
+type HistoryGap struct {
+	// From is the time of the last record read before the gap
+	From time.Time
+
+	// To is the time of the oldest record read after the gap
+	To time.Time
+}
+
+// NativeEvent describes an event of the kernel module's event queue, as
+// printed by zpool events -v. Fields the event does not have are zero.
+type NativeEvent struct {
+	// Class is the event class, e.g. "ereport.fs.zfs.checksum"
+	Class string
+
+	// EID is the event id, which increases until the module is reloaded
+	EID uint64
+
+	// PoolGUID is the GUID of the pool
+	PoolGUID uint64
+
+	// VdevGUID, VdevPath and VdevType identify the vdev the event is about
+	VdevGUID uint64
+	VdevPath string
+	VdevType string
+
+	// VdevState and VdevLastState are the state of the vdev after and
+	// before a state change, as zpool status shows them, e.g. "FAULTED"
+	VdevState     string
+	VdevLastState string
+
+	// ReadErrors, WriteErrors and ChecksumErrors are the error counts of
+	// the vdev
+	ReadErrors     uint64
+	WriteErrors    uint64
+	ChecksumErrors uint64
+
+	// Payload holds every top-level member of the event as printed, with
+	// the quotes around strings removed. Embedded nvlists are left out.
+	Payload map[string]string
+}
+
 // ZFSEvent represents a parsed ZFS event
 type ZFSEvent struct {
 	// Timestamp is when the event occurred
 	Timestamp time.Time
 
-	// Command is the raw ZFS command executed
+	// Command is the raw ZFS command executed, or the event class for
+	// events read with zpool events
 	Command string
 
+	// ParsedCommand is the parsed form of Command. It is nil for events
+	// that no history command caused: internal events, history gaps and
+	// events with Source SourceZpoolEvents, SourceZed or SourceReconcile.
+	ParsedCommand *zfscmd.Command
+
+	// Source is what the event was derived from, or "" for events of a
+	// command in pool history
+	Source EventSource
+
+	// ChannelProgram is the script of a channel program run with zfs
+	// program, set on the run and the events synthesized from it (if
+	// applicable)
+	ChannelProgram string
+
+	// Internal is set for events reported from an internal record of zpool
+	// history -i that no user command explained. Command is the record,
+	// e.g. "[txg:1234] destroy tank/vol@snap (768)".
+	Internal bool
+
+	// TXG is the transaction group the event was written in (if known)
+	TXG uint64
+
+	// ObjectID is the object id of the dataset or snapshot, as recorded in
+	// internal history (if known)
+	ObjectID uint64
+
 	// Pool is the ZFS pool name
 	Pool string
 
+	// User, UID, Hostname and Zone tell who ran the command and where, as
+	// recorded by zpool history -l. User is empty for users without a name
+	// and UID is -1 for records that name no user, such as internal ones.
+	// If long format history is not read, UID is -1 and the others are
+	// empty.
+	User     string
+	UID      int
+	Hostname string
+	Zone     string
+
 	// Type is the event type
 	Type EventType
 
 	// Target is the volume or snapshot ID
 	Target string
 
+	// Dataset is the full name of the affected dataset, including the pool
+	Dataset string
+
 	// VolumeID is the volume identifier (without snapshot suffix if present)
 	VolumeID string
 
 	// SnapshotID is the snapshot identifier (if applicable)
 	SnapshotID string
 
-	// Size is the size in KB for resize events (if applicable)
+	// BookmarkID is the bookmark name, the part after '#' (if applicable)
+	BookmarkID string
+
+	// Size is the size in KB for volume creation and resize events (if
+	// applicable), or empty if the size given is not a valid zfs size
 	Size string
+
+	// SizeText is the size as given on the command line, e.g. "10G" or
+	// "1048576KB" (if applicable)
+	SizeText string
+
+	// SizeBytes is SizeText in bytes, or 0 if it is not a valid zfs size
+	SizeBytes uint64
+
+	// OldTarget and NewTarget are the targets before and after a rename
+	// (if applicable). Either is empty if the naming scheme does not
+	// recognize that name.
+	OldTarget string
+	NewTarget string
+
+	// HoldTag is the tag of a hold placed or released (if applicable)
+	HoldTag string
+
+	// Recursive is set if the command was given -r or -R
+	Recursive bool
+
+	// RecursiveClones is set if a zfs destroy or rollback was given -R,
+	// which destroys the clones of the snapshots it destroys as well
+	RecursiveClones bool
+
+	// RecursiveParent is the full name of the dataset or snapshot a
+	// recursive command named, set on the events derived from it for the
+	// other datasets and snapshots the command affected
+	RecursiveParent string
+
+	// DestroyedSnapshots are the names of the snapshots a rollback destroyed
+	// implicitly because they were newer than its target (if known)
+	DestroyedSnapshots []string
+
+	// DestroyedClones are the full names of the clones of those snapshots
+	// that a rollback with -R destroyed with them (if known)
+	DestroyedClones []string
+
+	// Origin is the full name of the snapshot a clone was created from, for
+	// promotions the snapshot the clone originated from (if known), and for
+	// bookmarks the snapshot or bookmark the bookmark was created from
+	Origin string
+
+	// Device is the device a pool command acts on: the device attached to,
+	// detached or replaced (if applicable)
+	Device string
+
+	// NewDevice is the device attached, or the device replacing Device
+	// (if applicable)
+	NewDevice string
+
+	// Devices are the devices named by zpool online, offline, trim and
+	// clear, or the vdev specification of zpool add, as given (if
+	// applicable)
+	Devices []string
+
+	// Encryption holds the encryption parameters of a created dataset or
+	// a key change (if applicable)
+	Encryption *EncryptionInfo
+
+	// Receive describes a received stream (if applicable)
+	Receive *ReceiveInfo
+
+	// Native describes an event read with zpool events (if applicable)
+	Native *NativeEvent
+
+	// Gap is the time window a history gap event warns about (if
+	// applicable)
+	Gap *HistoryGap
+
+	// Properties are the properties set by the command, e.g. the -o
+	// mountpoint, quota or recordsize given on creation or the key=value
+	// pairs of zfs set. For zfs inherit the properties map to "".
+	Properties map[string]string
 }
@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+)
+
+// attributionRE matches the attribution zpool history -l appends to each
+// record, e.g. " [user 0 (root) on host:global]". The user name is missing
+// for users without a passwd entry, the user for internal records and the
+// zone on systems without zones.
+var attributionRE = regexp.MustCompile(`^(.*) \[(?:user (\d+) (?:\(([^)]*)\) ?)?)?(?:on ([^:\]]*)(?::([^\]]*))?)?\]$`)
+
+// attribution is who ran a command recorded in pool history, and where
+type attribution struct {
+	user     string
+	uid      int
+	hostname string
+	zone     string
+}
+
+// parseAttribution splits the attribution off a record of zpool history -l.
+// It returns false if the record has none.
+func parseAttribution(record string) (string, attribution, bool) {
+	match := attributionRE.FindStringSubmatch(record)
+	if match == nil {
+		return record, attribution{}, false
+	}
+
+	a := attribution{uid: -1, user: match[3], hostname: match[4], zone: match[5]}
+	if match[2] != "" {
+		a.uid, _ = strconv.Atoi(match[2])
+	}
+	return match[1], a, true
+}
+
+// apply sets the attribution fields of an event
+func (a attribution) apply(event *models.ZFSEvent) {
+	event.User = a.user
+	event.UID = a.uid
+	event.Hostname = a.hostname
+	event.Zone = a.zone
+}
+
+// formatAttribution returns who ran the command of an event and where as
+// " by root (uid 0) on host:zone", or "" if the event is not attributed
+func formatAttribution(event models.ZFSEvent) string {
+	var result string
+	switch {
+	case event.User != "":
+		result = fmt.Sprintf(" by %s (uid %d)", event.User, event.UID)
+	case event.UID >= 0 && event.Hostname != "":
+		result = fmt.Sprintf(" by uid %d", event.UID)
+	}
+	if event.Hostname != "" {
+		result += " on " + event.Hostname
+		if event.Zone != "" {
+			result += ":" + event.Zone
+		}
+	}
+	return result
+}
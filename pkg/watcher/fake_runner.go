@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FakeRunner is an in-memory StreamRunner. It returns canned output for
+// registered command lines and serves zpool history from records held in
+// memory, so the watcher can be exercised without a real zpool binary.
+type FakeRunner struct {
+	mu        sync.Mutex
+	outputs   map[string][]byte
+	errors    map[string]error
+	histories map[string][]string
+	calls     []string
+}
+
+// NewFakeRunner creates an empty FakeRunner
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		outputs:   make(map[string][]byte),
+		errors:    make(map[string]error),
+		histories: make(map[string][]string),
+	}
+}
+
+// SetOutput registers the output returned for a command line. The command
+// name is matched on its base name, so any configured zpool path matches.
+func (f *FakeRunner) SetOutput(output string, name string, args ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outputs[commandKey(name, args)] = []byte(output)
+}
+
+// SetError registers the error returned for a command line
+func (f *FakeRunner) SetError(err error, name string, args ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[commandKey(name, args)] = err
+}
+
+// SetHistory replaces the history records of a pool. Records use the
+// zpool history format, e.g. "2024-01-01.10:00:00 zfs snapshot pool1/vol@snap".
+func (f *FakeRunner) SetHistory(pool string, records ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.histories[pool] = append([]string(nil), records...)
+}
+
+// AppendHistory appends records to the history of a pool
+func (f *FakeRunner) AppendHistory(pool string, records ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.histories[pool] = append(f.histories[pool], records...)
+}
+
+// Calls returns the command lines run so far
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Output returns the registered output for the command line
+func (f *FakeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := commandKey(name, args)
+	f.calls = append(f.calls, key)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err, ok := f.errors[key]; ok {
+		return nil, err
+	}
+	if output, ok := f.outputs[key]; ok {
+		return output, nil
+	}
+
+	// Serve zpool history [flags] <pool> from the in-memory records
+	if filepath.Base(name) == "zpool" && len(args) > 1 && args[0] == "history" {
+		pool := args[len(args)-1]
+		if records, ok := f.histories[pool]; ok {
+			var b strings.Builder
+			fmt.Fprintf(&b, "History for '%s':\n", pool)
+			for _, record := range records {
+				b.WriteString(record)
+				b.WriteByte('\n')
+			}
+			b.WriteByte('\n')
+			return []byte(b.String()), nil
+		}
+		return nil, fmt.Errorf("cannot open '%s': no such pool", pool)
+	}
+
+	return nil, fmt.Errorf("no output registered for %q", key)
+}
+
+// Stream returns the registered output for the command line as a stream
+// that ends after the output, as if the command exited
+func (f *FakeRunner) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	output, err := f.Output(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(output)), nil
+}
+
+// commandKey returns the lookup key for a command line
+func commandKey(name string, args []string) string {
+	return strings.Join(append([]string{filepath.Base(name)}, args...), " ")
+}
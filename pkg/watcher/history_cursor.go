@@ -0,0 +1,185 @@
+package watcher
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+)
+
+// historyCursor records how far into a pool's history the watcher has read,
+// so that each poll only parses the records appended since the previous one
+type historyCursor struct {
+	// offset is the byte offset of lastRecord within the history output
+	offset int
+
+	// lastRecord is the last history record consumed from the pool
+	lastRecord string
+}
+
+// resumeOffset returns the offset in output from which unread records start.
+// If the history was truncated or rotated since the last poll, the cursor is
+// re-synchronised by searching for the last consumed record; when that record
+// is gone entirely the whole output is rescanned and the lastEvents dedup
+// keeps already reported events from being reported twice. lost reports
+// that the last consumed record is gone.
+func (w *Watcher) resumeOffset(pool string, output []byte) (offset int, lost bool) {
+	cursor, ok := w.cursors[pool]
+	if !ok {
+		return 0, false
+	}
+
+	// Fast path: the history has only been appended to since the last poll
+	if recordAt(output, cursor.offset, cursor.lastRecord) {
+		return endOfRecord(output, cursor.offset, cursor.lastRecord), false
+	}
+
+	// The history changed shape, look for the last record we consumed
+	if offset := findRecord(output, cursor.lastRecord); offset >= 0 {
+		return endOfRecord(output, offset, cursor.lastRecord), false
+	}
+
+	return 0, true
+}
+
+// historyGap returns the event warning that records of a pool's history may
+// have been dropped unread, for output in which the last consumed record is
+// gone. The ring drops the oldest records first, keeping only the one of
+// the pool's creation, so every record after it up to the last consumed one
+// is gone as well, and unread records may have followed. The gap reaches
+// from the last consumed record to the oldest record left at or after its
+// time, or to now if there is none.
+func (w *Watcher) historyGap(pool string, output []byte) models.ZFSEvent {
+	from, _ := recordTime(w.cursors[pool].lastRecord)
+	to := time.Now()
+	for offset := 0; offset < len(output); {
+		var line string
+		line, offset = nextLine(output, offset)
+		if t, ok := recordTime(line); ok && !t.Before(from) {
+			to = t
+			break
+		}
+	}
+	return gapEvent(pool, from, to)
+}
+
+// historyJump returns the event warning that records of a pool's history may
+// have been dropped unread, if the first record of unread output follows the
+// last consumed record by more than Config.GapThreshold. This catches losses
+// that leave the last consumed record in place, such as a cursor resynchronised
+// on a later record identical to it.
+func (w *Watcher) historyJump(pool string, unread []byte) (models.ZFSEvent, bool) {
+	cursor, ok := w.cursors[pool]
+	if !ok || w.config.GapThreshold <= 0 {
+		return models.ZFSEvent{}, false
+	}
+	from, ok := recordTime(cursor.lastRecord)
+	if !ok {
+		return models.ZFSEvent{}, false
+	}
+
+	for offset := 0; offset < len(unread); {
+		var line string
+		line, offset = nextLine(unread, offset)
+		if to, ok := recordTime(line); ok {
+			if to.Sub(from) <= w.config.GapThreshold {
+				return models.ZFSEvent{}, false
+			}
+			return gapEvent(pool, from, to), true
+		}
+	}
+	return models.ZFSEvent{}, false
+}
+
+// gapEvent returns a history gap event of a pool for the window from..to
+func gapEvent(pool string, from time.Time, to time.Time) models.ZFSEvent {
+	return models.ZFSEvent{
+		Timestamp: to,
+		Pool:      pool,
+		UID:       -1,
+		Type:      models.EventHistoryGap,
+		Target:    pool,
+		Gap:       &models.HistoryGap{From: from, To: to},
+	}
+}
+
+// historyTimeLayout is the layout of the timestamps of history records
+const historyTimeLayout = "2006-01-02.15:04:05"
+
+// parseRecordTime parses the timestamp of a history record. zpool history
+// prints the local time, which is read as such so that records compare with
+// the times of other sources and the current time.
+func parseRecordTime(timestamp string) (time.Time, error) {
+	return time.ParseInLocation(historyTimeLayout, timestamp, time.Local)
+}
+
+// recordTime returns the timestamp of a history record
+func recordTime(record string) (time.Time, bool) {
+	timestamp, _, _ := strings.Cut(record, " ")
+	t, err := parseRecordTime(timestamp)
+	return t, err == nil
+}
+
+// advanceCursor moves the pool cursor to the record found at offset
+func (w *Watcher) advanceCursor(pool string, offset int, record string) {
+	cursor, ok := w.cursors[pool]
+	if !ok {
+		cursor = &historyCursor{}
+		w.cursors[pool] = cursor
+	}
+	cursor.offset = offset
+	cursor.lastRecord = record
+}
+
+// nextLine returns the line starting at offset and the offset of the line
+// that follows it
+func nextLine(output []byte, offset int) (string, int) {
+	end := bytes.IndexByte(output[offset:], '\n')
+	if end < 0 {
+		return string(output[offset:]), len(output)
+	}
+	return string(output[offset : offset+end]), offset + end + 1
+}
+
+// recordAt reports whether record occupies a whole line at offset in output
+func recordAt(output []byte, offset int, record string) bool {
+	end := offset + len(record)
+	if offset < 0 || end > len(output) {
+		return false
+	}
+	if offset > 0 && output[offset-1] != '\n' {
+		return false
+	}
+	if end < len(output) && output[end] != '\n' {
+		return false
+	}
+	return string(output[offset:end]) == record
+}
+
+// findRecord returns the offset of the last line in output equal to record,
+// or -1 if there is none
+func findRecord(output []byte, record string) int {
+	needle := []byte(record)
+	limit := len(output)
+	for limit > 0 {
+		offset := bytes.LastIndex(output[:limit], needle)
+		if offset < 0 {
+			return -1
+		}
+		if recordAt(output, offset, record) {
+			return offset
+		}
+		limit = offset + len(needle) - 1
+	}
+	return -1
+}
+
+// endOfRecord returns the offset of the line following record at offset
+func endOfRecord(output []byte, offset int, record string) int {
+	end := offset + len(record)
+	if end < len(output) {
+		end++
+	}
+	return end
+}
@@ -0,0 +1,111 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildHistory returns zpool history output for pool with n records
+func buildHistory(pool string, n int) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "History for '%s':\n", pool)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		ts := start.Add(time.Duration(i) * time.Second).Format("2006-01-02.15:04:05")
+		fmt.Fprintf(&b, "%s zfs snapshot %s/volume-0a1b2c3d_%d@snapshot-%08x\n", ts, pool, i%10, i)
+	}
+	return []byte(b.String())
+}
+
+// setupPoll returns a watcher that has read a history of the given size, its
+// cursor and the history with ten records appended
+func setupPoll(records int) (*Watcher, historyCursor, []byte) {
+	const pool = "pool1"
+	history := buildHistory(pool, records+10)
+	base := history[:len(buildHistory(pool, records))]
+
+	w := New(Config{Pools: []string{pool}})
+	w.processHistoryOutput(context.Background(), pool, base, true)
+	return w, *w.cursors[pool], history
+}
+
+// poll processes history from cursor as a poll would
+func poll(w *Watcher, cursor historyCursor, history []byte) {
+	*w.cursors["pool1"] = cursor
+	w.processHistoryOutput(context.Background(), "pool1", history, false)
+}
+
+// benchmarkPoll measures the cost of a poll that finds ten new records
+// appended to a history of the given size
+func benchmarkPoll(b *testing.B, records int) {
+	w, cursor, history := setupPoll(records)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		poll(w, cursor, history)
+	}
+}
+
+func BenchmarkPoll1k(b *testing.B)   { benchmarkPoll(b, 1000) }
+func BenchmarkPoll10k(b *testing.B)  { benchmarkPoll(b, 10000) }
+func BenchmarkPoll100k(b *testing.B) { benchmarkPoll(b, 100000) }
+
+// BenchmarkInitialScan measures a full scan of a 100k record history, which
+// is what every poll cost before the cursor was introduced
+func BenchmarkInitialScan100k(b *testing.B) {
+	const pool = "pool1"
+	history := buildHistory(pool, 100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := New(Config{Pools: []string{pool}})
+		w.processHistoryOutput(context.Background(), pool, history, true)
+	}
+}
+
+// fastest returns the shortest of three timings of f
+func fastest(f func()) time.Duration {
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		f()
+		if elapsed := time.Since(start); i == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best
+}
+
+// TestPollCostFlat guards what the benchmarks above measure: a poll costs
+// the same however long the history, and a scan grows linearly with it
+func TestPollCostFlat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reads a 100k record history")
+	}
+
+	pollCost := func(records int) time.Duration {
+		w, cursor, history := setupPoll(records)
+		return fastest(func() {
+			for i := 0; i < 100; i++ {
+				poll(w, cursor, history)
+			}
+		})
+	}
+	if small, large := pollCost(1000), pollCost(100000); large > 10*small {
+		t.Errorf("polls of a 100k record history took %v, %v for 1k records", large, small)
+	}
+
+	scanCost := func(records int) time.Duration {
+		history := buildHistory("pool1", records)
+		return fastest(func() {
+			w := New(Config{Pools: []string{"pool1"}})
+			w.processHistoryOutput(context.Background(), "pool1", history, true)
+		})
+	}
+	if small, large := scanCost(10000), scanCost(100000); large > 30*small {
+		t.Errorf("scanning a 100k record history took %v, %v for 10k records", large, small)
+	}
+}
@@ -0,0 +1,270 @@
+package watcher
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+	"github.com/QumulusTechnology/zfs-tools/pkg/zfscmd"
+)
+
+// internalRecordRE matches the internal events of zpool history -i, e.g.
+// "[txg:1234] snapshot tank/vol@snap (768) " or
+// "[txg:1235] set tank/vol (54) volsize=2147483648". Records about the pool
+// as a whole, such as "[txg:4] open pool version 5000", have no name.
+var internalRecordRE = regexp.MustCompile(`^\[txg:(\d+)\] (\S+)(?: ([^ ()]+) \((\d+)\))? ?(.*)$`)
+
+// internalRecord is an internal event recorded in pool history
+type internalRecord struct {
+	timestamp time.Time
+
+	// command is the record without its timestamp
+	command string
+
+	txg       uint64
+	operation string
+
+	// name is the dataset or snapshot the record is about, with its
+	// object id, or "" for records about the pool
+	name     string
+	objectID uint64
+
+	// details is the rest of the record, e.g. "volsize=2147483648"
+	details string
+
+	// attribution is who wrote the record, if recorded
+	attribution attribution
+
+	// stale is set once the record survived a poll without being
+	// correlated
+	stale bool
+}
+
+// parseInternalRecord parses the command part of an internal history record
+func parseInternalRecord(timestamp time.Time, command string) (*internalRecord, bool) {
+	match := internalRecordRE.FindStringSubmatch(strings.TrimRight(command, " "))
+	if match == nil {
+		return nil, false
+	}
+	txg, _ := strconv.ParseUint(match[1], 10, 64)
+	objectID, _ := strconv.ParseUint(match[4], 10, 64)
+	return &internalRecord{
+		timestamp: timestamp,
+		command:   command,
+		txg:       txg,
+		operation: match[2],
+		name:      match[3],
+		objectID:  objectID,
+		details:   match[5],
+	}, true
+}
+
+// addInternal records an internal record of a pool, to be correlated with
+// the user command that follows it. Records about the pool as a whole and
+// about temporary datasets, such as the %recv clone of a receive, are
+// dropped.
+func (inv *inventory) addInternal(pool string, record *internalRecord) {
+	if record.name == "" || strings.Contains(record.name, "%") {
+		return
+	}
+	inv.pending[pool] = append(inv.pending[pool], record)
+}
+
+// correlate attaches the internal records read since the previous user
+// command of a pool to the events of the command, setting their TXG and
+// ObjectID. Records about the datasets the command named, or their
+// descendants if it was recursive, are explained by it; the others are
+// queued to be reported as internal events.
+func (w *Watcher) correlate(events []models.ZFSEvent, parsed *zfscmd.Command, pool string, inv *inventory) {
+	records := inv.pending[pool]
+	delete(inv.pending, pool)
+
+	for i := range events {
+		if record := matchRecord(events[i], records); record != nil {
+			events[i].TXG = record.txg
+			events[i].ObjectID = record.objectID
+		}
+	}
+
+	recursive := parsed.HasFlag("r") || parsed.HasFlag("R")
+	for _, record := range records {
+		if !explains(parsed, recursive, record) {
+			inv.unexplained[pool] = append(inv.unexplained[pool], w.internalEvents(internalBase(record, pool), record, inv)...)
+		}
+	}
+}
+
+// matchRecord returns the record about the dataset or snapshot of an event:
+// the record with the event's name if there is one, else the first about its
+// dataset
+func matchRecord(event models.ZFSEvent, records []*internalRecord) *internalRecord {
+	if event.Dataset == "" {
+		return nil
+	}
+	name := event.Dataset
+	if event.SnapshotID != "" {
+		name += "@" + event.SnapshotID
+	}
+
+	var match *internalRecord
+	for _, record := range records {
+		if record.name == name {
+			return record
+		}
+		if dataset, _, _ := strings.Cut(record.name, "@"); dataset == event.Dataset && match == nil {
+			match = record
+		}
+	}
+	return match
+}
+
+// explains reports whether a record is about a dataset a command named.
+// Snapshot records are only explained by commands naming snapshots of the
+// dataset or recursive commands, not by those naming the dataset alone.
+func explains(parsed *zfscmd.Command, recursive bool, record *internalRecord) bool {
+	about := zfscmd.ParseTarget(record.name)
+	for _, target := range parsed.Targets {
+		if about.Dataset != target.Dataset && !(recursive && isDescendant(about.Dataset, target.Dataset)) {
+			continue
+		}
+		if about.Kind != zfscmd.KindSnapshot || target.Kind != zfscmd.KindDataset || recursive {
+			return true
+		}
+	}
+	return false
+}
+
+// takeUnexplained returns and forgets the internal events of a pool that the
+// last user command did not explain
+func (inv *inventory) takeUnexplained(pool string) []models.ZFSEvent {
+	events := inv.unexplained[pool]
+	delete(inv.unexplained, pool)
+	return events
+}
+
+// staleInternal returns the internal events of the records of a pool that
+// no user command explained for a whole poll, so records written without a
+// user command, e.g. by the ZFS Event Daemon, are not held back forever.
+// With all set every pending record is returned.
+func (w *Watcher) staleInternal(pool string, inv *inventory, all bool) []models.ZFSEvent {
+	var events []models.ZFSEvent
+	var pending []*internalRecord
+	for _, record := range inv.pending[pool] {
+		if record.stale || all {
+			events = append(events, w.internalEvents(internalBase(record, pool), record, inv)...)
+		} else {
+			record.stale = true
+			pending = append(pending, record)
+		}
+	}
+	inv.pending[pool] = pending
+	return events
+}
+
+// programEvents returns the events of a zfs program command: the run of the
+// channel program and, with internal events, the events synthesized from the
+// internal records of the transaction group it ran in. The channel program's
+// records are the ones read right before the command, as the records read
+// before the previous user command were taken by it, that are of the same
+// transaction group and were written in the same second as the command. A
+// program that changed nothing has none.
+func (w *Watcher) programEvents(event models.ZFSEvent, parsed *zfscmd.Command, pool string, inv *inventory) []models.ZFSEvent {
+	if len(parsed.Args) < 2 {
+		return nil
+	}
+	event.Type = models.EventChannelProgramRun
+	event.Target = event.Pool
+	event.ChannelProgram = parsed.Args[1]
+	events := []models.ZFSEvent{event}
+
+	records := inv.pending[pool]
+	if len(records) == 0 || parsed.HasFlag("n") {
+		return events
+	}
+	txg := records[len(records)-1].txg
+	start := len(records)
+	for start > 0 && records[start-1].txg == txg && records[start-1].timestamp.Equal(event.Timestamp) {
+		start--
+	}
+
+	effect := event
+	effect.Source = models.SourceChannelProgram
+	for _, record := range records[start:] {
+		events = append(events, w.internalEvents(effect, record, inv)...)
+	}
+	inv.pending[pool] = records[:start]
+	return events
+}
+
+// internalBase returns the event an internal record that no user command
+// explained is reported as
+func internalBase(record *internalRecord, pool string) models.ZFSEvent {
+	event := models.ZFSEvent{
+		Timestamp: record.timestamp,
+		Command:   record.command,
+		Pool:      pool,
+		Internal:  true,
+	}
+	record.attribution.apply(&event)
+	return event
+}
+
+// internalEvents returns the events of an internal record, based on event,
+// and updates the inventory accordingly. Only operations with a clear meaning
+// on their own are reported.
+func (w *Watcher) internalEvents(event models.ZFSEvent, record *internalRecord, inv *inventory) []models.ZFSEvent {
+	event.TXG = record.txg
+	event.ObjectID = record.objectID
+	target := zfscmd.ParseTarget(record.name)
+
+	switch record.operation {
+	case "snapshot":
+		if target.Kind != zfscmd.KindSnapshot {
+			return nil
+		}
+		inv.touch(record.name, false)
+		inv.addSnapshot(target.Dataset, target.Snapshot)
+		event.Type = models.EventSnapshotCreated
+	case "destroy":
+		inv.touch(record.name, target.Kind == zfscmd.KindDataset)
+		event.Type = destroyedTypes(inv, []zfscmd.Target{target})[0]
+		inv.destroy(target)
+	case "set":
+		key, value, ok := strings.Cut(record.details, "=")
+		if !ok {
+			return nil
+		}
+		inv.touch(record.name, false)
+		event.Type = models.EventPropertySet
+		event.Properties = map[string]string{key: value}
+	case "rename":
+		newName := strings.TrimPrefix(record.details, "-> ")
+		if newName == record.details {
+			return nil
+		}
+		inv.touch(record.name, true)
+		inv.touch(newName, true)
+		to := zfscmd.ParseTarget(newName)
+		if target.Kind == zfscmd.KindSnapshot {
+			inv.renameSnapshot(target.Dataset, target.Snapshot, to.Snapshot)
+			event.Type = models.EventSnapshotRenamed
+		} else {
+			inv.rename(target.Dataset, to.Dataset)
+			event.Type = models.EventDatasetRenamed
+		}
+		renamed, ok := w.renamedEvent(event, target, to)
+		if !ok {
+			return nil
+		}
+		return []models.ZFSEvent{renamed}
+	default:
+		return nil
+	}
+
+	if !w.identify(&event, target) {
+		return nil
+	}
+	return []models.ZFSEvent{event}
+}
@@ -0,0 +1,460 @@
+package watcher
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+	"github.com/QumulusTechnology/zfs-tools/pkg/zfscmd"
+)
+
+// datasetType is the type of a dataset known to the inventory
+type datasetType string
+
+const (
+	datasetFilesystem datasetType = "filesystem"
+	datasetVolume     datasetType = "volume"
+
+	// datasetUnknown is the type of datasets known to exist, but not what
+	// they are, such as datasets created by a receive
+	datasetUnknown datasetType = ""
+)
+
+// inventory tracks the datasets and snapshots created and destroyed in pool
+// history, so that commands which do not spell out everything they affect,
+// such as zfs destroy or zfs rename -r, can be reported precisely. It also
+// holds the internal records waiting to be correlated with a user command.
+type inventory struct {
+	datasets map[string]datasetType
+
+	// snapshots maps datasets to their snapshot names, oldest first, and
+	// snapshotSet holds the same names for lookups
+	snapshots   map[string][]string
+	snapshotSet map[string]map[string]struct{}
+
+	// origins maps clones to the snapshot they were created from
+	origins map[string]string
+
+	// listed holds the datasets whose descendants were added from zfs list
+	listed map[string]bool
+
+	// live is set while the inventory follows new history, the only time
+	// zfs list shows the datasets history records are about
+	live bool
+
+	// pending holds the internal records of each pool read since its last
+	// user command
+	pending map[string][]*internalRecord
+
+	// unexplained holds the events of the internal records of each pool
+	// that its last user command did not explain
+	unexplained map[string][]models.ZFSEvent
+
+	// touched and wasTouched hold the names history changed since the
+	// last listing of reconciliation and between the two before, mapped to
+	// whether the change was recursive
+	touched    map[string]bool
+	wasTouched map[string]bool
+}
+
+// newInventory creates an empty inventory
+func newInventory() *inventory {
+	return &inventory{
+		datasets:    make(map[string]datasetType),
+		snapshots:   make(map[string][]string),
+		snapshotSet: make(map[string]map[string]struct{}),
+		origins:     make(map[string]string),
+		listed:      make(map[string]bool),
+
+		pending:     make(map[string][]*internalRecord),
+		unexplained: make(map[string][]models.ZFSEvent),
+
+		touched:    make(map[string]bool),
+		wasTouched: make(map[string]bool),
+	}
+}
+
+// add records a dataset of the given type
+func (inv *inventory) add(dataset string, kind datasetType) {
+	inv.datasets[dataset] = kind
+}
+
+// addParents records the missing ancestors of a dataset, which zfs create,
+// clone and rename -p create as filesystems
+func (inv *inventory) addParents(dataset string) {
+	for _, parent := range inv.missingParents(dataset) {
+		inv.add(parent, datasetFilesystem)
+	}
+}
+
+// missingParents returns the ancestors of a dataset below its pool that are
+// not known, closest first
+func (inv *inventory) missingParents(dataset string) []string {
+	var parents []string
+	for i := strings.LastIndex(dataset, "/"); i > 0; i = strings.LastIndex(dataset[:i], "/") {
+		parent := dataset[:i]
+		if _, ok := inv.datasets[parent]; ok || !strings.Contains(parent, "/") {
+			break
+		}
+		parents = append(parents, parent)
+	}
+	return parents
+}
+
+// addSnapshot records a new snapshot of a dataset
+func (inv *inventory) addSnapshot(dataset string, snapshot string) {
+	if inv.hasSnapshot(dataset, snapshot) {
+		return
+	}
+	inv.snapshots[dataset] = append(inv.snapshots[dataset], snapshot)
+	set, ok := inv.snapshotSet[dataset]
+	if !ok {
+		set = make(map[string]struct{})
+		inv.snapshotSet[dataset] = set
+	}
+	set[snapshot] = struct{}{}
+}
+
+// setSnapshots replaces the snapshots of a dataset, oldest first
+func (inv *inventory) setSnapshots(dataset string, snapshots []string) {
+	if len(snapshots) == 0 {
+		delete(inv.snapshots, dataset)
+		delete(inv.snapshotSet, dataset)
+		return
+	}
+	set := make(map[string]struct{}, len(snapshots))
+	for _, snapshot := range snapshots {
+		set[snapshot] = struct{}{}
+	}
+	inv.snapshots[dataset] = snapshots
+	inv.snapshotSet[dataset] = set
+}
+
+// addClone records a clone of the origin snapshot. The clone has the type
+// of the origin's dataset, if that is known.
+func (inv *inventory) addClone(clone string, origin string) {
+	dataset, _, _ := strings.Cut(origin, "@")
+	if kind, ok := inv.datasets[dataset]; ok {
+		inv.datasets[clone] = kind
+	}
+	inv.origins[clone] = origin
+}
+
+// promote records the promotion of a clone: the clone takes over the origin
+// snapshot and the ones before it, and the dataset it was cloned from becomes
+// a clone of it
+func (inv *inventory) promote(clone string) {
+	origin, ok := inv.origins[clone]
+	if !ok {
+		return
+	}
+	delete(inv.origins, clone)
+
+	dataset, snapshot, _ := strings.Cut(origin, "@")
+	inv.origins[dataset] = clone + "@" + snapshot
+
+	snapshots := inv.snapshots[dataset]
+	for i, name := range snapshots {
+		if name == snapshot {
+			moved := append([]string(nil), snapshots[:i+1]...)
+			inv.setSnapshots(clone, append(moved, inv.snapshots[clone]...))
+			inv.setSnapshots(dataset, append([]string(nil), snapshots[i+1:]...))
+			break
+		}
+	}
+}
+
+// origin returns the snapshot a clone was created from, if known
+func (inv *inventory) origin(clone string) (string, bool) {
+	origin, ok := inv.origins[clone]
+	return origin, ok
+}
+
+// remove forgets a dataset and its descendants
+func (inv *inventory) remove(dataset string) {
+	for name := range inv.datasets {
+		if name == dataset || isDescendant(name, dataset) {
+			delete(inv.datasets, name)
+		}
+	}
+	for name := range inv.snapshots {
+		if name == dataset || isDescendant(name, dataset) {
+			delete(inv.snapshots, name)
+			delete(inv.snapshotSet, name)
+		}
+	}
+	for name := range inv.origins {
+		if name == dataset || isDescendant(name, dataset) {
+			delete(inv.origins, name)
+		}
+	}
+}
+
+// removeSnapshot forgets a snapshot of a dataset
+func (inv *inventory) removeSnapshot(dataset string, snapshot string) {
+	if !inv.hasSnapshot(dataset, snapshot) {
+		return
+	}
+	snapshots := inv.snapshots[dataset]
+	for i, name := range snapshots {
+		if name == snapshot {
+			inv.setSnapshots(dataset, append(snapshots[:i:i], snapshots[i+1:]...))
+			return
+		}
+	}
+}
+
+// destroy forgets a destroyed dataset or snapshot
+func (inv *inventory) destroy(target zfscmd.Target) {
+	if target.Kind == zfscmd.KindSnapshot {
+		inv.removeSnapshot(target.Dataset, target.Snapshot)
+	} else {
+		inv.remove(target.Dataset)
+	}
+}
+
+// destroyedWith returns the known datasets and snapshots that a recursive
+// destroy of target destroys along with it: the descendants of a dataset, or
+// the snapshots of the same names of the descendants of a snapshot's dataset.
+// With dependents, the clones of any destroyed snapshot and what is destroyed
+// with them are included as well, as zfs destroy -R does.
+func (inv *inventory) destroyedWith(target zfscmd.Target, dependents bool) []zfscmd.Target {
+	var result []zfscmd.Target
+	seen := map[string]bool{target.Name: true}
+	queue := []zfscmd.Target{target}
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			destroyed := zfscmd.ParseTarget(name)
+			result = append(result, destroyed)
+			queue = append(queue, destroyed)
+		}
+	}
+
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		for _, dataset := range inv.descendants(next.Dataset) {
+			if next.Kind != zfscmd.KindSnapshot {
+				add(dataset)
+				continue
+			}
+			snapshots, _ := inv.snapshotsIn(dataset, next.Snapshot)
+			for _, snapshot := range snapshots {
+				if inv.hasSnapshot(dataset, snapshot) {
+					add(dataset + "@" + snapshot)
+				}
+			}
+		}
+		if dependents {
+			for _, clone := range inv.clones(next) {
+				add(clone)
+			}
+		}
+	}
+	return result
+}
+
+// snapshotsIn returns the snapshots of a dataset named by the snapshot part
+// of a zfs destroy operand: a comma separated list of names and first%last
+// ranges, in which either end may be omitted to start at the oldest or end at
+// the newest snapshot. Ranges are resolved against the known snapshots; a
+// range whose first end is newer than its last names none. If an end of a
+// range is not known, the ends given are returned instead and complete is
+// false, as the snapshots between them are not known.
+func (inv *inventory) snapshotsIn(dataset string, spec string) (names []string, complete bool) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	snapshots := inv.snapshots[dataset]
+	index := func(name string, missing int) int {
+		if name == "" {
+			return missing
+		}
+		for i, snapshot := range snapshots {
+			if snapshot == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	complete = true
+	for _, part := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(part, "%")
+		if !isRange {
+			add(part)
+			continue
+		}
+
+		from, to := index(first, 0), index(last, len(snapshots)-1)
+		if from < 0 || to < 0 {
+			add(first)
+			add(last)
+			complete = false
+			continue
+		}
+		for i := from; i <= to; i++ {
+			add(snapshots[i])
+		}
+	}
+	return names, complete
+}
+
+// clones returns the known clones of the snapshots a zfs destroy operand
+// names, or of any snapshot of a dataset, in name order
+func (inv *inventory) clones(target zfscmd.Target) []string {
+	origins := make(map[string]bool)
+	if target.Kind == zfscmd.KindSnapshot {
+		snapshots, _ := inv.snapshotsIn(target.Dataset, target.Snapshot)
+		for _, snapshot := range snapshots {
+			origins[target.Dataset+"@"+snapshot] = true
+		}
+	}
+
+	var names []string
+	for clone, origin := range inv.origins {
+		dataset, _, _ := strings.Cut(origin, "@")
+		if origins[origin] || (target.Kind == zfscmd.KindDataset && dataset == target.Dataset) {
+			names = append(names, clone)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// markListed records that the descendants of a dataset were listed
+func (inv *inventory) markListed(dataset string) {
+	inv.listed[dataset] = true
+}
+
+// wasListed reports whether the descendants of a dataset were listed, as
+// part of its own listing or that of an ancestor
+func (inv *inventory) wasListed(dataset string) bool {
+	for name := range inv.listed {
+		if name == dataset || isDescendant(dataset, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollback records the rollback of a dataset to a snapshot, which destroys
+// the newer snapshots. It returns the names of the destroyed snapshots.
+func (inv *inventory) rollback(dataset string, snapshot string) []string {
+	if !inv.hasSnapshot(dataset, snapshot) {
+		return nil
+	}
+	snapshots := inv.snapshots[dataset]
+	for i, name := range snapshots {
+		if name == snapshot {
+			destroyed := append([]string(nil), snapshots[i+1:]...)
+			inv.setSnapshots(dataset, snapshots[:i+1:i+1])
+			return destroyed
+		}
+	}
+	return nil
+}
+
+// rename records the rename of a dataset, which renames its descendants and
+// snapshots with it
+func (inv *inventory) rename(oldName string, newName string) {
+	renamed := func(name string) (string, bool) {
+		if name == oldName || isDescendant(name, oldName) {
+			return newName + name[len(oldName):], true
+		}
+		return "", false
+	}
+
+	for name, kind := range inv.datasets {
+		if to, ok := renamed(name); ok {
+			delete(inv.datasets, name)
+			inv.datasets[to] = kind
+		}
+	}
+	for name, snapshots := range inv.snapshots {
+		if to, ok := renamed(name); ok {
+			set := inv.snapshotSet[name]
+			delete(inv.snapshots, name)
+			delete(inv.snapshotSet, name)
+			inv.snapshots[to] = snapshots
+			inv.snapshotSet[to] = set
+		}
+	}
+	for name, origin := range inv.origins {
+		dataset, snapshot, _ := strings.Cut(origin, "@")
+		if to, ok := renamed(dataset); ok {
+			origin = to + "@" + snapshot
+			inv.origins[name] = origin
+		}
+		if to, ok := renamed(name); ok {
+			delete(inv.origins, name)
+			inv.origins[to] = origin
+		}
+	}
+}
+
+// renameSnapshot records the rename of a snapshot of a dataset
+func (inv *inventory) renameSnapshot(dataset string, oldName string, newName string) {
+	if inv.hasSnapshot(dataset, oldName) {
+		for i, name := range inv.snapshots[dataset] {
+			if name == oldName {
+				inv.snapshots[dataset][i] = newName
+				break
+			}
+		}
+		delete(inv.snapshotSet[dataset], oldName)
+		inv.snapshotSet[dataset][newName] = struct{}{}
+	}
+	for clone, origin := range inv.origins {
+		if origin == dataset+"@"+oldName {
+			inv.origins[clone] = dataset + "@" + newName
+		}
+	}
+}
+
+// kind returns the type of a dataset, if known
+func (inv *inventory) kind(dataset string) (datasetType, bool) {
+	kind, ok := inv.datasets[dataset]
+	return kind, ok
+}
+
+// hasSnapshot reports whether a dataset is known to have a snapshot
+func (inv *inventory) hasSnapshot(dataset string, snapshot string) bool {
+	_, ok := inv.snapshotSet[dataset][snapshot]
+	return ok
+}
+
+// descendants returns the known descendants of a dataset in name order
+func (inv *inventory) descendants(dataset string) []string {
+	seen := make(map[string]bool)
+	for name := range inv.datasets {
+		if isDescendant(name, dataset) {
+			seen[name] = true
+		}
+	}
+	for name := range inv.snapshots {
+		if isDescendant(name, dataset) {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isDescendant reports whether dataset is a descendant of parent
+func isDescendant(dataset string, parent string) bool {
+	return len(dataset) > len(parent) && dataset[len(parent)] == '/' && dataset[:len(parent)] == parent
+}
@@ -0,0 +1,84 @@
+package watcher
+
+import (
+	"regexp"
+	"strings"
+)
+
+// NamingScheme maps the datasets and snapshots found in pool history to the
+// volume and snapshot identifiers reported on events
+type NamingScheme interface {
+	// VolumeID returns the volume identifier of a dataset, given its full
+	// name including the pool. It returns false if the dataset should not
+	// be reported.
+	VolumeID(dataset string) (string, bool)
+
+	// SnapshotID returns the snapshot identifier of a snapshot, given the
+	// name after the '@'. It returns false if the snapshot should not be
+	// reported.
+	SnapshotID(snapshot string) (string, bool)
+}
+
+// PathNaming is the default NamingScheme. Volumes are identified by their
+// dataset path below the pool and snapshots by their name, so every dataset
+// is reported.
+type PathNaming struct{}
+
+// VolumeID returns the dataset path below the pool
+func (PathNaming) VolumeID(dataset string) (string, bool) {
+	if i := strings.IndexByte(dataset, '/'); i >= 0 {
+		return dataset[i+1:], true
+	}
+	return dataset, true
+}
+
+// SnapshotID returns the snapshot name unchanged
+func (PathNaming) SnapshotID(snapshot string) (string, bool) {
+	return snapshot, true
+}
+
+// RegexpNaming is a NamingScheme that only reports names matching regular
+// expressions. Volume is matched against the dataset path below the pool and
+// Snapshot against the snapshot name; the first submatch, or the whole match
+// if the expression has no groups, becomes the identifier. A nil expression
+// accepts every name as is.
+type RegexpNaming struct {
+	Volume   *regexp.Regexp
+	Snapshot *regexp.Regexp
+}
+
+// VolumeID returns the identifier matched in the dataset path below the pool
+func (n RegexpNaming) VolumeID(dataset string) (string, bool) {
+	path, _ := PathNaming{}.VolumeID(dataset)
+	return matchID(n.Volume, path)
+}
+
+// SnapshotID returns the identifier matched in the snapshot name
+func (n RegexpNaming) SnapshotID(snapshot string) (string, bool) {
+	return matchID(n.Snapshot, snapshot)
+}
+
+// CinderNaming returns the naming scheme used for OpenStack Cinder volumes,
+// which live directly below the pool as volume-<uuid>_<n> and are
+// snapshotted as snapshot-<uuid>
+func CinderNaming() RegexpNaming {
+	return RegexpNaming{
+		Volume:   regexp.MustCompile(`^(volume-[a-f0-9\-]+_\d+)$`),
+		Snapshot: regexp.MustCompile(`^(snapshot-[a-f0-9\-]+)$`),
+	}
+}
+
+// matchID returns the identifier matched by re in name
+func matchID(re *regexp.Regexp, name string) (string, bool) {
+	if re == nil {
+		return name, true
+	}
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	if len(match) > 1 {
+		return match[1], true
+	}
+	return match[0], true
+}
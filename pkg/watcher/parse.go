@@ -0,0 +1,809 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+	"github.com/QumulusTechnology/zfs-tools/pkg/zfscmd"
+)
+
+// parseEvents parses a line from zpool history output into the events it
+// describes. A command with several targets yields one event per target. The
+// inventory is updated with the datasets the command creates or destroys.
+// ctx bounds the zfs commands run to expand recursive commands.
+func (w *Watcher) parseEvents(ctx context.Context, line string, pool string, inv *inventory) ([]models.ZFSEvent, error) {
+	event := models.ZFSEvent{Pool: pool}
+
+	// Parse timestamp and command
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid format")
+	}
+
+	timestamp := parts[0]
+	command := parts[1]
+
+	// Split off who ran the command, if recorded
+	attributed := attribution{uid: -1}
+	if w.config.LongFormat {
+		if stripped, a, ok := parseAttribution(command); ok {
+			command, attributed = stripped, a
+		}
+	}
+	attributed.apply(&event)
+
+	// Parse the timestamp
+	t, err := parseRecordTime(timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %v", err)
+	}
+	event.Timestamp = t
+	event.Command = command
+
+	// Internal records are correlated with the user command that follows
+	if record, ok := parseInternalRecord(t, command); ok {
+		record.attribution = attributed
+		inv.addInternal(pool, record)
+		return nil, fmt.Errorf("internal record")
+	}
+
+	// Parse the command line
+	parsed, err := zfscmd.ParseHistory(command, pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command: %v", err)
+	}
+	event.ParsedCommand = parsed
+	inv.touchCommand(parsed)
+
+	var events []models.ZFSEvent
+	switch parsed.Program {
+	case "zfs":
+		switch parsed.Subcommand {
+		case "create":
+			events = w.createEvents(event, parsed, inv)
+		case "set":
+			events = w.setEvents(event, parsed)
+		case "inherit":
+			events = w.inheritEvents(event, parsed)
+		case "snapshot":
+			events = w.snapshotEvents(ctx, event, parsed, inv)
+		case "destroy":
+			events = w.destroyEvents(event, parsed, inv)
+		case "clone":
+			events = w.cloneEvents(event, parsed, inv)
+		case "promote":
+			events = w.promoteEvents(event, parsed, inv)
+		case "rename":
+			events = w.renameEvents(event, parsed, inv)
+		case "rollback":
+			events = w.rollbackEvents(event, parsed, inv)
+		case "bookmark":
+			events = w.bookmarkEvents(event, parsed)
+		case "load-key":
+			events = w.keyEvents(event, parsed, models.EventKeyLoaded)
+		case "unload-key":
+			events = w.keyEvents(event, parsed, models.EventKeyUnloaded)
+		case "change-key":
+			events = w.keyEvents(event, parsed, models.EventKeyChanged)
+		case "receive":
+			events = w.receiveEvents(event, parsed, inv)
+		case "program":
+			events = w.programEvents(event, parsed, pool, inv)
+		case "hold":
+			events = w.holdEvents(event, parsed, inv, models.EventSnapshotHeld)
+		case "release":
+			events = w.holdEvents(event, parsed, inv, models.EventSnapshotReleased)
+		}
+	case "zpool":
+		events = poolEvents(event, parsed)
+	}
+	w.correlate(events, parsed, pool, inv)
+
+	if len(events) == 0 {
+		return nil, fmt.Errorf("not a matching event")
+	}
+	return events, nil
+}
+
+// createEvents returns the events of a zfs create command. Volumes are
+// created with -V, anything else is a filesystem, as are the parents created
+// with -p.
+func (w *Watcher) createEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	target, ok := parsed.Target()
+	if !ok || target.Kind != zfscmd.KindDataset {
+		return nil
+	}
+
+	if parsed.HasFlag("p") {
+		inv.addParents(target.Dataset)
+	}
+	size, isVolume := parsed.Flag("V")
+	if isVolume {
+		inv.add(target.Dataset, datasetVolume)
+	} else {
+		inv.add(target.Dataset, datasetFilesystem)
+	}
+
+	if !w.identify(&event, target) {
+		return nil
+	}
+	if isVolume {
+		event.Type = models.EventVolumeCreated
+		setSize(&event, size)
+	} else {
+		event.Type = models.EventFilesystemCreated
+	}
+	event.Encryption = encryptionInfo(parsed.Properties)
+	event.Properties = copyProperties(parsed.Properties)
+	return []models.ZFSEvent{event}
+}
+
+// setEvents returns the events of a zfs set command: a property event for
+// each target and, if volsize is set, a resize event for each dataset
+func (w *Watcher) setEvents(event models.ZFSEvent, parsed *zfscmd.Command) []models.ZFSEvent {
+	if len(parsed.Properties) == 0 {
+		return nil
+	}
+	size, resized := parsed.Properties["volsize"]
+
+	var events []models.ZFSEvent
+	for _, target := range parsed.Targets {
+		set := event
+		if target.Kind == zfscmd.KindBookmark || !w.identify(&set, target) {
+			continue
+		}
+		set.Type = models.EventPropertySet
+		set.Properties = copyProperties(parsed.Properties)
+		events = append(events, set)
+
+		if resized && target.Kind == zfscmd.KindDataset {
+			resize := set
+			resize.Type = models.EventVolumeResized
+			setSize(&resize, size)
+			resize.Properties = nil
+			events = append(events, resize)
+		}
+	}
+	return events
+}
+
+// inheritEvents returns the events of a zfs inherit command
+func (w *Watcher) inheritEvents(event models.ZFSEvent, parsed *zfscmd.Command) []models.ZFSEvent {
+	if len(parsed.Args) == 0 {
+		return nil
+	}
+	property := parsed.Args[0]
+
+	var events []models.ZFSEvent
+	for _, target := range parsed.Targets {
+		inherited := event
+		if target.Kind == zfscmd.KindBookmark || !w.identify(&inherited, target) {
+			continue
+		}
+		inherited.Type = models.EventPropertyInherited
+		inherited.Recursive = parsed.HasFlag("r")
+		inherited.Properties = map[string]string{property: ""}
+		events = append(events, inherited)
+	}
+	return events
+}
+
+// snapshotEvents returns the events of a zfs snapshot command. With -r the
+// descendants of each dataset are snapshotted as well; they are reported as
+// events derived from the named snapshot if ExpandRecursive is set.
+func (w *Watcher) snapshotEvents(ctx context.Context, event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	recursive := parsed.HasFlag("r")
+
+	var events []models.ZFSEvent
+	for _, target := range parsed.Targets {
+		if target.Kind != zfscmd.KindSnapshot {
+			continue
+		}
+
+		var derived []zfscmd.Target
+		if recursive {
+			w.listDescendants(ctx, target.Dataset, inv)
+			for _, dataset := range inv.descendants(target.Dataset) {
+				derived = append(derived, zfscmd.ParseTarget(dataset+"@"+target.Snapshot))
+			}
+		}
+		inv.addSnapshot(target.Dataset, target.Snapshot)
+		for _, child := range derived {
+			inv.addSnapshot(child.Dataset, child.Snapshot)
+		}
+
+		created := event
+		created.Type = models.EventSnapshotCreated
+		created.Recursive = recursive
+		events = append(events, w.targetEvents(created, []zfscmd.Target{target}, nil)...)
+		events = append(events, w.derivedEvents(created, target, derived, nil)...)
+	}
+	return events
+}
+
+// destroyEvents returns the events of a zfs destroy command. Datasets not
+// created within the known history are reported as volumes. A snapshot list
+// or range such as pool/vol@a,b or pool/vol@a%c is reported as one event per
+// snapshot, unless an end of a range is not known: the operand is reported as
+// given then. With -r the descendants of a dataset, or the snapshots of the
+// same names of its descendants, are destroyed as well, and with -R also the
+// clones depending on anything destroyed; they are reported as events
+// derived from the named target if ExpandRecursive is set.
+func (w *Watcher) destroyEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	recursive := parsed.HasFlag("r") || parsed.HasFlag("R")
+
+	var events []models.ZFSEvent
+	for _, target := range parsed.Targets {
+		if target.Kind == zfscmd.KindBookmark {
+			destroyed := event
+			destroyed.Type = models.EventBookmarkDeleted
+			events = append(events, w.targetEvents(destroyed, []zfscmd.Target{target}, nil)...)
+			continue
+		}
+
+		named := []zfscmd.Target{target}
+		reported := named
+		if target.Kind == zfscmd.KindSnapshot {
+			snapshots, complete := inv.snapshotsIn(target.Dataset, target.Snapshot)
+			named = nil
+			for _, snapshot := range snapshots {
+				named = append(named, zfscmd.ParseTarget(target.Dataset+"@"+snapshot))
+			}
+			if complete {
+				reported = named
+			}
+		}
+
+		var derived []zfscmd.Target
+		if recursive {
+			derived = inv.destroyedWith(target, parsed.HasFlag("R"))
+		}
+
+		// The types must be looked up before the inventory forgets them
+		reportedTypes := destroyedTypes(inv, reported)
+		derivedTypes := destroyedTypes(inv, derived)
+		for _, destroyed := range append(named, derived...) {
+			inv.destroy(destroyed)
+		}
+
+		destroyed := event
+		destroyed.Recursive = recursive
+		destroyed.RecursiveClones = parsed.HasFlag("R")
+		events = append(events, w.targetEvents(destroyed, reported, reportedTypes)...)
+		events = append(events, w.derivedEvents(destroyed, target, derived, derivedTypes)...)
+	}
+	return events
+}
+
+// destroyedTypes returns the types of the events reporting the destruction
+// of targets
+func destroyedTypes(inv *inventory, targets []zfscmd.Target) []models.EventType {
+	types := make([]models.EventType, len(targets))
+	for i, target := range targets {
+		kind, _ := inv.kind(target.Dataset)
+		switch {
+		case target.Kind == zfscmd.KindSnapshot:
+			types[i] = models.EventSnapshotDeleted
+		case kind == datasetFilesystem:
+			types[i] = models.EventFilesystemDeleted
+		default:
+			types[i] = models.EventVolumeDeleted
+		}
+	}
+	return types
+}
+
+// targetEvents returns a copy of event for each target the naming scheme
+// reports, with the type given in types, or the type of the event if types
+// is nil
+func (w *Watcher) targetEvents(event models.ZFSEvent, targets []zfscmd.Target, types []models.EventType) []models.ZFSEvent {
+	var events []models.ZFSEvent
+	for i, target := range targets {
+		targetEvent := event
+		if !w.identify(&targetEvent, target) {
+			continue
+		}
+		if types != nil {
+			targetEvent.Type = types[i]
+		}
+		events = append(events, targetEvent)
+	}
+	return events
+}
+
+// derivedEvents returns the events derived from a recursive command on
+// parent for the other targets the command affected, if ExpandRecursive is
+// set. The types are given as for targetEvents.
+func (w *Watcher) derivedEvents(event models.ZFSEvent, parent zfscmd.Target, derived []zfscmd.Target, types []models.EventType) []models.ZFSEvent {
+	if !w.config.ExpandRecursive {
+		return nil
+	}
+	event.Recursive = true
+	event.RecursiveParent = parent.Name
+	return w.targetEvents(event, derived, types)
+}
+
+// listDescendants adds a dataset and the descendants it has now to the
+// inventory, if ListDescendants is set, so that recursive commands on
+// datasets created before the known history can be expanded. Datasets are
+// only listed while new history is followed, as zfs list shows what exists
+// now, and each is listed once it succeeds; datasets that no longer exist are
+// left to the inventory.
+func (w *Watcher) listDescendants(ctx context.Context, dataset string, inv *inventory) {
+	if !w.config.ListDescendants || !inv.live || inv.wasListed(dataset) {
+		return
+	}
+
+	output, err := w.config.Runner.Output(ctx, w.config.ZfsCmd,
+		"list", "-H", "-o", "name,type", "-r", "-t", "filesystem,volume", dataset)
+	if err != nil {
+		return
+	}
+	inv.markListed(dataset)
+	for _, line := range strings.Split(string(output), "\n") {
+		name, kind, ok := strings.Cut(line, "\t")
+		if !ok || (name != dataset && !isDescendant(name, dataset)) {
+			continue
+		}
+		if known, ok := inv.kind(name); !ok || known == datasetUnknown {
+			inv.add(name, datasetType(kind))
+		}
+	}
+}
+
+// cloneEvents returns the events of a zfs clone command
+func (w *Watcher) cloneEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	if len(parsed.Targets) != 2 {
+		return nil
+	}
+	origin, clone := parsed.Targets[0], parsed.Targets[1]
+	if origin.Kind != zfscmd.KindSnapshot || clone.Kind != zfscmd.KindDataset {
+		return nil
+	}
+
+	if parsed.HasFlag("p") {
+		inv.addParents(clone.Dataset)
+	}
+	inv.addClone(clone.Dataset, origin.Name)
+
+	if !w.identify(&event, clone) {
+		return nil
+	}
+	event.Type = models.EventCloneCreated
+	event.Origin = origin.Name
+	event.Properties = copyProperties(parsed.Properties)
+	return []models.ZFSEvent{event}
+}
+
+// promoteEvents returns the events of a zfs promote command
+func (w *Watcher) promoteEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	target, ok := parsed.Target()
+	if !ok || target.Kind != zfscmd.KindDataset {
+		return nil
+	}
+
+	origin, _ := inv.origin(target.Dataset)
+	inv.promote(target.Dataset)
+
+	if !w.identify(&event, target) {
+		return nil
+	}
+	event.Type = models.EventClonePromoted
+	event.Origin = origin
+	return []models.ZFSEvent{event}
+}
+
+// renameEvents returns the events of a zfs rename command. A recursive
+// snapshot rename yields an event for the named dataset and one for each
+// descendant known to have the snapshot.
+func (w *Watcher) renameEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	if len(parsed.Targets) != 2 {
+		return nil
+	}
+	from, to := parsed.Targets[0], parsed.Targets[1]
+
+	if from.Kind == zfscmd.KindDataset {
+		if to.Kind != zfscmd.KindDataset {
+			return nil
+		}
+		if parsed.HasFlag("p") {
+			inv.addParents(to.Dataset)
+		}
+		inv.rename(from.Dataset, to.Dataset)
+
+		renamed, ok := w.renamedEvent(event, from, to)
+		if !ok {
+			return nil
+		}
+		renamed.Type = models.EventDatasetRenamed
+		return []models.ZFSEvent{renamed}
+	}
+
+	if from.Kind != zfscmd.KindSnapshot {
+		return nil
+	}
+
+	// The new snapshot name may be abbreviated to "name" or "@name"
+	newSnapshot := strings.TrimPrefix(to.Name, "@")
+	if to.Kind == zfscmd.KindSnapshot {
+		newSnapshot = to.Snapshot
+	}
+
+	datasets := []string{from.Dataset}
+	if parsed.HasFlag("r") {
+		for _, dataset := range inv.descendants(from.Dataset) {
+			if inv.hasSnapshot(dataset, from.Snapshot) {
+				datasets = append(datasets, dataset)
+			}
+		}
+	}
+
+	var events []models.ZFSEvent
+	for _, dataset := range datasets {
+		inv.renameSnapshot(dataset, from.Snapshot, newSnapshot)
+
+		renamed, ok := w.renamedEvent(event,
+			zfscmd.ParseTarget(dataset+"@"+from.Snapshot),
+			zfscmd.ParseTarget(dataset+"@"+newSnapshot))
+		if !ok {
+			continue
+		}
+		renamed.Type = models.EventSnapshotRenamed
+		events = append(events, renamed)
+	}
+	return events
+}
+
+// rollbackEvents returns the events of a zfs rollback command. With -R the
+// clones of the snapshots destroyed are destroyed as well, along with what
+// zfs destroy -R would destroy with them, and reported like the targets
+// derived from a recursive destroy.
+func (w *Watcher) rollbackEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	target, ok := parsed.Target()
+	if !ok || target.Kind != zfscmd.KindSnapshot {
+		return nil
+	}
+
+	destroyed := inv.rollback(target.Dataset, target.Snapshot)
+
+	var clones, derived []zfscmd.Target
+	if parsed.HasFlag("R") {
+		for _, snapshot := range destroyed {
+			for _, clone := range inv.clones(zfscmd.ParseTarget(target.Dataset + "@" + snapshot)) {
+				clones = append(clones, zfscmd.ParseTarget(clone))
+			}
+		}
+		seen := make(map[string]bool)
+		for _, clone := range clones {
+			for _, name := range append([]zfscmd.Target{clone}, inv.destroyedWith(clone, true)...) {
+				if !seen[name.Name] {
+					seen[name.Name] = true
+					derived = append(derived, name)
+				}
+			}
+		}
+	}
+	derivedTypes := destroyedTypes(inv, derived)
+	for _, name := range derived {
+		inv.destroy(name)
+	}
+
+	if !w.identify(&event, target) {
+		return nil
+	}
+	event.Type = models.EventVolumeRolledBack
+	event.Recursive = parsed.HasFlag("r") || parsed.HasFlag("R")
+	event.RecursiveClones = parsed.HasFlag("R")
+	event.DestroyedSnapshots = destroyed
+	for _, clone := range clones {
+		event.DestroyedClones = append(event.DestroyedClones, clone.Name)
+	}
+
+	events := []models.ZFSEvent{event}
+	deleted := event
+	deleted.DestroyedSnapshots = nil
+	deleted.DestroyedClones = nil
+	return append(events, w.derivedEvents(deleted, target, derived, derivedTypes)...)
+}
+
+// bookmarkEvents returns the events of a zfs bookmark command. The new
+// bookmark may be abbreviated to "#name", naming a bookmark of the source's
+// dataset.
+func (w *Watcher) bookmarkEvents(event models.ZFSEvent, parsed *zfscmd.Command) []models.ZFSEvent {
+	if len(parsed.Targets) != 2 {
+		return nil
+	}
+	source, bookmark := parsed.Targets[0], parsed.Targets[1]
+	if source.Kind == zfscmd.KindDataset || bookmark.Kind != zfscmd.KindBookmark {
+		return nil
+	}
+	if bookmark.Dataset == "" {
+		bookmark = zfscmd.ParseTarget(source.Dataset + bookmark.Name)
+	}
+
+	if !w.identify(&event, bookmark) {
+		return nil
+	}
+	event.Type = models.EventBookmarkCreated
+	event.Origin = source.Name
+	return []models.ZFSEvent{event}
+}
+
+// keyEvents returns the events of a zfs load-key, unload-key or change-key
+// command, which have the given type. With -a the keys of every dataset
+// are loaded or unloaded and the event targets the pool.
+func (w *Watcher) keyEvents(event models.ZFSEvent, parsed *zfscmd.Command, typ models.EventType) []models.ZFSEvent {
+	event.Type = typ
+	event.Recursive = parsed.HasFlag("r")
+	if typ == models.EventKeyChanged {
+		event.Encryption = encryptionInfo(parsed.Properties)
+		if parsed.HasFlag("i") {
+			event.Encryption = &models.EncryptionInfo{Inherited: true}
+		}
+		event.Properties = copyProperties(parsed.Properties)
+	}
+
+	if parsed.HasFlag("a") {
+		event.Target = event.Pool
+		return []models.ZFSEvent{event}
+	}
+
+	var targets []zfscmd.Target
+	for _, target := range parsed.Targets {
+		if target.Kind == zfscmd.KindDataset {
+			targets = append(targets, target)
+		}
+	}
+	return w.targetEvents(event, targets, nil)
+}
+
+// encryptionInfo returns the encryption parameters among properties, or nil
+// if there are none
+func encryptionInfo(properties map[string]string) *models.EncryptionInfo {
+	info := models.EncryptionInfo{
+		Algorithm:        properties["encryption"],
+		KeyFormat:        properties["keyformat"],
+		KeyLocation:      properties["keylocation"],
+		PBKDF2Iterations: properties["pbkdf2iters"],
+	}
+	if info == (models.EncryptionInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+// receiveEvents returns the events of a zfs receive command. Pool history
+// does not record the stream, so whether it was full or incremental is
+// inferred from the known snapshots of the target: an incremental stream
+// needs one, a full stream can only replace a dataset without any.
+func (w *Watcher) receiveEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory) []models.ZFSEvent {
+	target, ok := parsed.Target()
+	if !ok || target.Kind == zfscmd.KindBookmark {
+		return nil
+	}
+
+	info := &models.ReceiveInfo{
+		Force:          parsed.HasFlag("F"),
+		NoMount:        parsed.HasFlag("u"),
+		Resumable:      parsed.HasFlag("s"),
+		NameFromStream: parsed.HasFlag("d") || parsed.HasFlag("e"),
+		Excluded:       append([]string(nil), parsed.Flags["x"]...),
+	}
+	if !info.NameFromStream {
+		_, known := inv.kind(target.Dataset)
+		switch {
+		case len(inv.snapshots[target.Dataset]) > 0:
+			info.Stream = models.StreamIncremental
+		case known:
+			info.Stream = models.StreamFull
+		}
+		// A full stream creates the dataset if it does not exist, as a
+		// filesystem or volume depending on the stream. One replacing a
+		// dataset is of the same type in practice.
+		if !known {
+			inv.add(target.Dataset, datasetUnknown)
+		}
+		if target.Kind == zfscmd.KindSnapshot {
+			inv.addSnapshot(target.Dataset, target.Snapshot)
+		}
+	}
+
+	if !w.identify(&event, target) {
+		return nil
+	}
+	event.Type = models.EventReceived
+	event.Receive = info
+	event.Properties = copyProperties(parsed.Properties)
+	return []models.ZFSEvent{event}
+}
+
+// holdEvents returns the events of a zfs hold or zfs release command, which
+// have the given type. With -r the hold is placed on or released from the
+// snapshots of the same name of the descendants as well; they are reported
+// as events derived from the named snapshot if ExpandRecursive is set.
+func (w *Watcher) holdEvents(event models.ZFSEvent, parsed *zfscmd.Command, inv *inventory, typ models.EventType) []models.ZFSEvent {
+	if len(parsed.Args) == 0 {
+		return nil
+	}
+	recursive := parsed.HasFlag("r")
+
+	var events []models.ZFSEvent
+	for _, target := range parsed.Targets {
+		if target.Kind != zfscmd.KindSnapshot {
+			continue
+		}
+
+		var derived []zfscmd.Target
+		if recursive {
+			for _, dataset := range inv.descendants(target.Dataset) {
+				if inv.hasSnapshot(dataset, target.Snapshot) {
+					derived = append(derived, zfscmd.ParseTarget(dataset+"@"+target.Snapshot))
+				}
+			}
+		}
+
+		held := event
+		held.Type = typ
+		held.HoldTag = parsed.Args[0]
+		held.Recursive = recursive
+		events = append(events, w.targetEvents(held, []zfscmd.Target{target}, nil)...)
+		events = append(events, w.derivedEvents(held, target, derived, nil)...)
+	}
+	return events
+}
+
+// poolEvents returns the event of a zpool command administering the pool.
+// Pool events are reported for every pool, regardless of the naming scheme.
+func poolEvents(event models.ZFSEvent, parsed *zfscmd.Command) []models.ZFSEvent {
+	// The first operand is the pool, the others are devices
+	var devices []string
+	if len(parsed.Args) > 1 {
+		devices = parsed.Args[1:]
+	}
+
+	switch parsed.Subcommand {
+	case "scrub":
+		switch {
+		case parsed.HasFlag("s"):
+			event.Type = models.EventPoolScrubStopped
+		case parsed.HasFlag("p"):
+			event.Type = models.EventPoolScrubPaused
+		default:
+			event.Type = models.EventPoolScrubStarted
+		}
+	case "trim":
+		switch {
+		case parsed.HasFlag("c"):
+			event.Type = models.EventPoolTrimCancelled
+		case parsed.HasFlag("s"):
+			event.Type = models.EventPoolTrimSuspended
+		default:
+			event.Type = models.EventPoolTrimStarted
+		}
+		event.Devices = devices
+	case "add":
+		event.Type = models.EventPoolVdevAdded
+		event.Devices = devices
+	case "attach":
+		if len(devices) != 2 {
+			return nil
+		}
+		event.Type = models.EventPoolDeviceAttached
+		event.Device = devices[0]
+		event.NewDevice = devices[1]
+	case "detach":
+		if len(devices) != 1 {
+			return nil
+		}
+		event.Type = models.EventPoolDeviceDetached
+		event.Device = devices[0]
+	case "replace":
+		if len(devices) == 0 {
+			return nil
+		}
+		event.Type = models.EventPoolDeviceReplaced
+		event.Device = devices[0]
+		if len(devices) > 1 {
+			event.NewDevice = devices[1]
+		}
+	case "online":
+		event.Type = models.EventPoolDeviceOnline
+		event.Devices = devices
+	case "offline":
+		event.Type = models.EventPoolDeviceOffline
+		event.Devices = devices
+	case "import":
+		event.Type = models.EventPoolImported
+	case "export":
+		event.Type = models.EventPoolExported
+	case "upgrade":
+		event.Type = models.EventPoolUpgraded
+	case "clear":
+		event.Type = models.EventPoolCleared
+		event.Devices = devices
+	default:
+		return nil
+	}
+
+	event.Target = event.Pool
+	event.Properties = copyProperties(parsed.Properties)
+	return []models.ZFSEvent{event}
+}
+
+// renamedEvent returns a rename event from one target to another. The event
+// identifies the new name; it is reported if the naming scheme recognizes
+// either name, with the target of an unrecognized name left empty.
+func (w *Watcher) renamedEvent(event models.ZFSEvent, from zfscmd.Target, to zfscmd.Target) (models.ZFSEvent, bool) {
+	old := event
+	oldOK := w.identify(&old, from)
+	renamed := event
+	newOK := w.identify(&renamed, to)
+
+	switch {
+	case newOK && oldOK:
+		renamed.OldTarget = old.Target
+		renamed.NewTarget = renamed.Target
+	case newOK:
+		renamed.NewTarget = renamed.Target
+	case oldOK:
+		renamed = old
+		renamed.OldTarget = old.Target
+	default:
+		return event, false
+	}
+	return renamed, true
+}
+
+// identify sets the target, dataset, volume, snapshot and bookmark
+// identifiers of an event according to the naming scheme. It returns false
+// if the scheme does not report the dataset or snapshot. Bookmarks are
+// identified by their name.
+func (w *Watcher) identify(event *models.ZFSEvent, target zfscmd.Target) bool {
+	volumeID, ok := w.config.Naming.VolumeID(target.Dataset)
+	if !ok {
+		return false
+	}
+	event.Dataset = target.Dataset
+	event.VolumeID = volumeID
+	event.Target = volumeID
+
+	if target.Kind == zfscmd.KindSnapshot {
+		snapshotID, ok := w.config.Naming.SnapshotID(target.Snapshot)
+		if !ok {
+			return false
+		}
+		event.SnapshotID = snapshotID
+		event.Target = fmt.Sprintf("%s@%s", volumeID, snapshotID)
+	}
+	if target.Kind == zfscmd.KindBookmark {
+		event.BookmarkID = target.Bookmark
+		event.Target = fmt.Sprintf("%s#%s", volumeID, target.Bookmark)
+	}
+	return true
+}
+
+// copyProperties returns a copy of a property map, or nil if it is empty
+func copyProperties(properties map[string]string) map[string]string {
+	if len(properties) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(properties))
+	for key, value := range properties {
+		result[key] = value
+	}
+	return result
+}
+
+// setSize sets the size of an event to a size given on the command line
+func setSize(event *models.ZFSEvent, size string) {
+	event.SizeText = size
+	bytes, err := zfscmd.ParseSize(size)
+	if err != nil {
+		return
+	}
+	event.Size = strconv.FormatUint(bytes/1024, 10)
+	event.SizeBytes = bytes
+}
@@ -0,0 +1,350 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+	"github.com/QumulusTechnology/zfs-tools/pkg/zfscmd"
+)
+
+// reconcileArgs are the arguments of the zfs list command reconciliation
+// compares
+var reconcileArgs = []string{"list", "-H", "-p", "-t", "all", "-o", "name,type,volsize,used,creation,guid"}
+
+// createdTypes and deletedTypes map the types zfs list shows to the events
+// reported for their creation and deletion
+var (
+	createdTypes = map[string]models.EventType{
+		"filesystem": models.EventFilesystemCreated,
+		"volume":     models.EventVolumeCreated,
+		"snapshot":   models.EventSnapshotCreated,
+		"bookmark":   models.EventBookmarkCreated,
+	}
+	deletedTypes = map[string]models.EventType{
+		"filesystem": models.EventFilesystemDeleted,
+		"volume":     models.EventVolumeDeleted,
+		"snapshot":   models.EventSnapshotDeleted,
+		"bookmark":   models.EventBookmarkDeleted,
+	}
+)
+
+// listedDataset is a dataset, snapshot or bookmark as listed by zfs list
+type listedDataset struct {
+	kind     string
+	volsize  uint64
+	creation time.Time
+	guid     uint64
+}
+
+// reconcile lists the datasets of the monitored pools and reports the
+// creations, deletions and resizes since the previous listing that history
+// did not explain, and applies them to the inventory. History is read after
+// listing, so that the records of the changes the listing shows have been
+// read. The first listing is only recorded and adds what history did not
+// show to the inventory, as the records of older datasets may have left the
+// ring. Only errors that will not go away by themselves are returned.
+func (w *Watcher) reconcile(ctx context.Context) error {
+	listing, err := w.listDatasets(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if isFatal(err) {
+			return err
+		}
+		log.Printf("Error: %v", err)
+		return nil
+	}
+	w.inventory.rotateTouched()
+
+	for _, pool := range w.config.Pools {
+		if err := w.processPoolHistory(ctx, pool, false); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	if w.listing == nil {
+		w.seedInventory(listing)
+	} else {
+		for _, event := range w.reconciledEvents(w.listing, listing, time.Now()) {
+			w.dispatch(event)
+		}
+	}
+	w.listing = listing
+	return nil
+}
+
+// listDatasets returns the datasets, snapshots and bookmarks of the
+// monitored pools by name
+func (w *Watcher) listDatasets(ctx context.Context) (map[string]listedDataset, error) {
+	output, err := w.config.Runner.Output(ctx, w.config.ZfsCmd, reconcileArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing datasets: %w", err)
+	}
+
+	listing := make(map[string]listedDataset)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		pool, _, _ := strings.Cut(fields[0], "/")
+		pool, _, _ = strings.Cut(pool, "@")
+		pool, _, _ = strings.Cut(pool, "#")
+		if !w.monitors(pool) {
+			continue
+		}
+
+		// Sizes of other types than volumes are "-"
+		volsize, _ := strconv.ParseUint(fields[2], 10, 64)
+		creation, _ := strconv.ParseInt(fields[4], 10, 64)
+		guid, _ := strconv.ParseUint(fields[5], 10, 64)
+		listing[fields[0]] = listedDataset{
+			kind:     fields[1],
+			volsize:  volsize,
+			creation: time.Unix(creation, 0),
+			guid:     guid,
+		}
+	}
+	return listing, nil
+}
+
+// seedInventory adds the datasets and snapshots of a listing to the
+// inventory, as the records of older ones may have left the history ring.
+// Names that history read after the listing changed are left as history
+// has them. Snapshots are ordered by creation, followed by the ones history
+// created after the listing; datasets history created without telling their
+// type get the listed one.
+func (w *Watcher) seedInventory(listing map[string]listedDataset) {
+	inv := w.inventory
+	names := make([]string, 0, len(listing))
+	for name := range listing {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := listing[names[i]], listing[names[j]]
+		if !a.creation.Equal(b.creation) {
+			return a.creation.Before(b.creation)
+		}
+		return names[i] < names[j]
+	})
+
+	snapshots := make(map[string][]string)
+	for _, name := range names {
+		target := zfscmd.ParseTarget(name)
+		switch target.Kind {
+		case zfscmd.KindSnapshot:
+			if inv.hasSnapshot(target.Dataset, target.Snapshot) || !inv.explainedBy(inv.touched, name) {
+				snapshots[target.Dataset] = append(snapshots[target.Dataset], target.Snapshot)
+			}
+		case zfscmd.KindDataset:
+			kind, ok := inv.kind(name)
+			if (ok && kind == datasetUnknown) || (!ok && !inv.explainedBy(inv.touched, name)) {
+				inv.addListed(name, listing[name])
+			}
+		}
+	}
+
+	for dataset, listed := range snapshots {
+		seen := make(map[string]bool, len(listed))
+		for _, snapshot := range listed {
+			seen[snapshot] = true
+		}
+		for _, snapshot := range inv.snapshots[dataset] {
+			if !seen[snapshot] {
+				listed = append(listed, snapshot)
+			}
+		}
+		inv.setSnapshots(dataset, listed)
+	}
+}
+
+// reconciledEvents returns the events for the differences between two
+// listings that history did not explain, in name order, and applies them to
+// the inventory. A name whose GUID changed was destroyed and created again.
+func (w *Watcher) reconciledEvents(before, after map[string]listedDataset, now time.Time) []models.ZFSEvent {
+	names := make([]string, 0, len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var events []models.ZFSEvent
+	add := func(types map[string]models.EventType, name string, listed listedDataset, timestamp time.Time) {
+		typ, ok := types[listed.kind]
+		if !ok {
+			return
+		}
+		if event, ok := w.reconciledEvent(typ, name, listed, timestamp); ok {
+			events = append(events, event)
+		}
+	}
+
+	for _, name := range names {
+		old, existed := before[name]
+		listed, exists := after[name]
+		if kind, ok := w.inventory.kind(name); ok && kind == datasetUnknown && exists {
+			// History does not tell the type of received datasets
+			w.inventory.addListed(name, listed)
+		}
+		if w.inventory.explained(name) {
+			continue
+		}
+		switch {
+		case !existed:
+			add(createdTypes, name, listed, listed.creation)
+			w.inventory.addListed(name, listed)
+		case !exists:
+			add(deletedTypes, name, old, now)
+			w.inventory.destroy(zfscmd.ParseTarget(name))
+		case old.guid != listed.guid:
+			add(deletedTypes, name, old, now)
+			add(createdTypes, name, listed, listed.creation)
+			w.inventory.destroy(zfscmd.ParseTarget(name))
+			w.inventory.addListed(name, listed)
+		case listed.kind == "volume" && old.volsize != listed.volsize:
+			if event, ok := w.reconciledEvent(models.EventVolumeResized, name, listed, now); ok {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// reconciledEvent returns an event of reconciliation about a listed name,
+// unless the naming scheme ignores it
+func (w *Watcher) reconciledEvent(typ models.EventType, name string, listed listedDataset, timestamp time.Time) (models.ZFSEvent, bool) {
+	pool, _, _ := strings.Cut(name, "/")
+	event := models.ZFSEvent{
+		Timestamp: timestamp,
+		Command:   "zfs " + strings.Join(reconcileArgs, " "),
+		Source:    models.SourceReconcile,
+		Pool:      pool,
+		UID:       -1,
+		Type:      typ,
+	}
+	if typ == models.EventVolumeCreated || typ == models.EventVolumeResized {
+		setSize(&event, strconv.FormatUint(listed.volsize, 10))
+	}
+	if !w.identify(&event, zfscmd.ParseTarget(name)) {
+		return models.ZFSEvent{}, false
+	}
+	return event, true
+}
+
+// addListed records a dataset or snapshot that reconciliation found. Bookmarks
+// are not tracked.
+func (inv *inventory) addListed(name string, listed listedDataset) {
+	target := zfscmd.ParseTarget(name)
+	switch {
+	case target.Kind == zfscmd.KindSnapshot:
+		inv.addSnapshot(target.Dataset, target.Snapshot)
+	case target.Kind == zfscmd.KindDataset && listed.kind == "volume":
+		inv.add(name, datasetVolume)
+	case target.Kind == zfscmd.KindDataset:
+		inv.add(name, datasetFilesystem)
+	}
+}
+
+// touch records that history changed a dataset, snapshot or bookmark and,
+// if recursive, everything below it: the descendants and snapshots of a
+// dataset, or the snapshots of the same name of the descendants of a
+// snapshot's dataset
+func (inv *inventory) touch(name string, recursive bool) {
+	inv.touched[name] = inv.touched[name] || recursive
+}
+
+// touchCommand records the names a command changes, before it is applied to
+// the inventory. Commands that affect what they do not name, such as renames,
+// rollbacks and receives, touch their targets recursively.
+func (inv *inventory) touchCommand(parsed *zfscmd.Command) {
+	recursive := parsed.HasFlag("r") || parsed.HasFlag("R")
+	switch parsed.Subcommand {
+	case "rename", "rollback", "promote", "receive", "import", "export":
+		recursive = true
+	}
+
+	// Parents created by -p are named by none of the targets
+	switch parsed.Subcommand {
+	case "create", "clone", "rename":
+		if parsed.HasFlag("p") && len(parsed.Targets) > 0 {
+			for _, parent := range inv.missingParents(parsed.Targets[len(parsed.Targets)-1].Dataset) {
+				inv.touch(parent, false)
+			}
+		}
+	}
+
+	for _, target := range parsed.Targets {
+		switch {
+		case target.Kind == zfscmd.KindSnapshot && strings.ContainsAny(target.Snapshot, ",%"):
+			// Snapshots of a range that cannot be resolved are left for
+			// reconciliation to report
+			snapshots, _ := inv.snapshotsIn(target.Dataset, target.Snapshot)
+			for _, snapshot := range snapshots {
+				inv.touch(target.Dataset+"@"+snapshot, recursive)
+			}
+		case target.Kind == zfscmd.KindBookmark && target.Dataset == "":
+			// The #name shorthand of zfs bookmark names a bookmark of
+			// the source's dataset
+			inv.touch(parsed.Targets[0].Dataset+target.Name, recursive)
+		case target.Kind == zfscmd.KindDataset && parsed.Subcommand == "destroy":
+			// Destroying a dataset or pool destroys its bookmarks
+			inv.touch(target.Name, true)
+		default:
+			inv.touch(target.Name, recursive)
+		}
+	}
+}
+
+// explained reports whether history changed a dataset, snapshot or bookmark
+// since the previous listing, as touch records
+func (inv *inventory) explained(name string) bool {
+	return inv.explainedBy(inv.touched, name) || inv.explainedBy(inv.wasTouched, name)
+}
+
+// explainedBy reports whether touched holds a change of a dataset, snapshot
+// or bookmark
+func (inv *inventory) explainedBy(touched map[string]bool, name string) bool {
+	if _, ok := touched[name]; ok {
+		return true
+	}
+
+	target := zfscmd.ParseTarget(name)
+	for dataset := target.Dataset; dataset != ""; {
+		if touched[dataset] && (dataset != target.Dataset || target.Kind != zfscmd.KindDataset) {
+			return true
+		}
+		if target.Kind == zfscmd.KindSnapshot && touched[dataset+"@"+target.Snapshot] {
+			return true
+		}
+
+		i := strings.LastIndex(dataset, "/")
+		if i < 0 {
+			break
+		}
+		dataset = dataset[:i]
+	}
+	return false
+}
+
+// rotateTouched records that the datasets were listed. The names touched
+// since the previous listing are kept until the next, as they explain the
+// differences between the two; older ones are forgotten.
+func (inv *inventory) rotateTouched() {
+	inv.wasTouched = inv.touched
+	inv.touched = make(map[string]bool)
+}
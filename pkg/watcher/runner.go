@@ -0,0 +1,63 @@
+package watcher
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// CommandRunner runs the external commands the watcher depends on, such as
+// zpool history. Replacing it lets the watcher run without a real zpool.
+type CommandRunner interface {
+	// Output runs the named command and returns its standard output. The
+	// command is killed if ctx is cancelled before it completes.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// StreamRunner is a CommandRunner that can also run commands that keep
+// writing output until they are stopped, such as zpool events -f
+type StreamRunner interface {
+	CommandRunner
+
+	// Stream starts the named command and returns its standard output as
+	// it is written. Closing the stream kills the command if it is still
+	// running and returns the error it exited with, as does cancelling ctx.
+	Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
+}
+
+// ExecRunner is the default CommandRunner, running commands with os/exec
+type ExecRunner struct{}
+
+// Output runs the named command and returns its standard output
+func (ExecRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// Stream starts the named command and returns its standard output
+func (ExecRunner) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &commandStream{ReadCloser: stdout, cmd: cmd, cancel: cancel}, nil
+}
+
+// commandStream is the standard output of a running command
+type commandStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+}
+
+// Close kills the command if it is still running and waits for it to exit
+func (s *commandStream) Close() error {
+	s.cancel()
+	return s.cmd.Wait()
+}
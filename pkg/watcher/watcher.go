@@ -2,11 +2,17 @@ package watcher
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"os/exec"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/QumulusTechnology/zfs-tools/pkg/models"
@@ -28,6 +34,66 @@ type Config struct {
 
 	// ZpoolCmd specifies the path to the zpool command
 	ZpoolCmd ZpoolCommand
+
+	// ZfsCmd specifies the path to the zfs command (default: zfs next to
+	// ZpoolCmd)
+	ZfsCmd string
+
+	// Runner runs the zpool commands (default: ExecRunner)
+	Runner CommandRunner
+
+	// InternalEvents reads pool history with zpool history -i, which adds
+	// the internal events written as commands take effect. Their TXG and
+	// object ID are set on the events of the user command they belong to;
+	// internal events no user command explains, e.g. those of channel
+	// programs or the ZFS Event Daemon, are reported on their own.
+	InternalEvents bool
+
+	// LongFormat reads pool history with zpool history -l, which records
+	// the user, host and zone each command was run by and on
+	LongFormat bool
+
+	// NativeEvents also follows the event queue of the kernel module with
+	// zpool events -f, reporting checksum and I/O errors, vdev state
+	// changes, resilvers, finished scrubs and other events pool history
+	// does not record. Runner must be a StreamRunner.
+	NativeEvents bool
+
+	// ReconcileInterval is the interval at which the datasets, snapshots
+	// and bookmarks of the pools are listed with zfs list and compared with
+	// the previous listing; the first listing is only recorded. Creations,
+	// deletions and volume resizes that history did not explain, e.g.
+	// because it was truncated, are reported with Source set to
+	// models.SourceReconcile (default: 0, never).
+	ReconcileInterval time.Duration
+
+	// GapThreshold reports a history gap when the first record read by a
+	// poll is more than this after the last record read before, as records
+	// between them may have been missed. Pools can be idle for long, so it
+	// should be well above the time between their changes (default: 0,
+	// never).
+	GapThreshold time.Duration
+
+	// EventSocket is the path of a Unix socket on which Run accepts events
+	// forwarded by zfs-watcher zedlet, or other SendEvent callers, and
+	// dispatches them to the event handlers (default: none)
+	EventSocket string
+
+	// Naming maps dataset and snapshot names to the reported volume and
+	// snapshot IDs (default: PathNaming)
+	Naming NamingScheme
+
+	// ExpandRecursive reports the descendants affected by zfs snapshot -r
+	// and zfs destroy -r/-R as events of their own, derived from the event
+	// of the dataset or snapshot the command named
+	ExpandRecursive bool
+
+	// ListDescendants makes recursive snapshots look up descendants with
+	// zfs list when they are first seen, for datasets created before the
+	// known history. The descendants are those that exist at the time of
+	// the lookup, so history read at startup or by GetEventsSince is not
+	// looked up.
+	ListDescendants bool
 }
 
 // EventHandler is a function that handles ZFS events
@@ -35,14 +101,25 @@ type EventHandler func(event models.ZFSEvent)
 
 // Watcher watches for ZFS changes
 type Watcher struct {
-	config          Config
-	lastEvents      map[string]time.Time
-	eventHandlers   []EventHandler
-	volumeCreateRE  *regexp.Regexp
-	volumeDestroyRE *regexp.Regexp
-	snapshotRE      *regexp.Regexp
-	volResizeRE     *regexp.Regexp
-	seenSinceEvent  bool
+	config         Config
+	lastEvents     map[string]time.Time
+	cursors        map[string]*historyCursor
+	inventory      *inventory
+	eventHandlers  []EventHandler
+	seenSinceEvent bool
+
+	// dispatchMu serializes handler calls from history and zpool events,
+	// and guards seenZevents and zeventOrder
+	dispatchMu sync.Mutex
+
+	// seenZevents holds the events of the kernel module's event queue
+	// reported last, at most zeventWindow of them, and zeventOrder the
+	// order they were reported in
+	seenZevents map[zeventKey]bool
+	zeventOrder []zeventKey
+
+	// listing is the last zfs list of reconciliation, nil before the first
+	listing map[string]listedDataset
 }
 
 // New creates a new ZFS watcher
@@ -52,20 +129,27 @@ func New(config Config) *Watcher {
 		config.ZpoolCmd = ZpoolCmdDefault
 	}
 
-	return &Watcher{
-		config:     config,
-		lastEvents: make(map[string]time.Time),
-		// Detect volume creation
-		volumeCreateRE: regexp.MustCompile(`zfs create\s+.*?(-s -V\s+(\d+)KB.*?)?pool\d+\/(volume-[a-f0-9\-]+_\d+)`),
+	// Use the zfs command installed next to zpool if not specified
+	if config.ZfsCmd == "" {
+		config.ZfsCmd = filepath.Join(filepath.Dir(string(config.ZpoolCmd)), "zfs")
+	}
 
-		// Detect volume deletion
-		volumeDestroyRE: regexp.MustCompile(`zfs destroy\s+pool\d+\/(volume-[a-f0-9\-]+_\d+)(?:\@(snapshot-[a-f0-9\-]+))?`),
+	// Run commands with os/exec unless a runner is specified
+	if config.Runner == nil {
+		config.Runner = ExecRunner{}
+	}
 
-		// Detect snapshot creation
-		snapshotRE: regexp.MustCompile(`zfs snapshot\s+pool\d+\/(volume-[a-f0-9\-]+_\d+)\@(snapshot-[a-f0-9\-]+)`),
+	// Report every dataset unless a naming scheme is specified
+	if config.Naming == nil {
+		config.Naming = PathNaming{}
+	}
 
-		// Detect volume resize
-		volResizeRE: regexp.MustCompile(`zfs set volsize=(\d+)KB\s+pool\d+\/(volume-[a-f0-9\-]+_\d+)`),
+	return &Watcher{
+		config:      config,
+		lastEvents:  make(map[string]time.Time),
+		cursors:     make(map[string]*historyCursor),
+		inventory:   newInventory(),
+		seenZevents: make(map[zeventKey]bool),
 
 		// Set to true if no sinceEvent is specified
 		seenSinceEvent: config.SinceEvent == "",
@@ -77,27 +161,113 @@ func (w *Watcher) AddEventHandler(handler EventHandler) {
 	w.eventHandlers = append(w.eventHandlers, handler)
 }
 
-// Start begins monitoring ZFS changes
-func (w *Watcher) Start() {
+// Run monitors ZFS changes until ctx is cancelled. On cancellation polling
+// stops, in-flight zpool commands are killed and Run returns nil once the
+// handler being called, if any, has finished. An error is returned if the
+// pools cannot be monitored at all, e.g. when the zpool binary is missing.
+func (w *Watcher) Run(ctx context.Context) error {
+	if w.config.Interval <= 0 {
+		return fmt.Errorf("invalid check interval %v", w.config.Interval)
+	}
+
+	var runner StreamRunner
+	if w.config.NativeEvents {
+		var ok bool
+		if runner, ok = w.config.Runner.(StreamRunner); !ok {
+			return fmt.Errorf("runner %T cannot follow zpool events", w.config.Runner)
+		}
+	}
+
+	var listener net.Listener
+	if w.config.EventSocket != "" {
+		var err error
+		if listener, err = listenEvents(w.config.EventSocket); err != nil {
+			return err
+		}
+		defer listener.Close()
+	}
+
 	log.Printf("Starting ZFS watcher for pools: %v", w.config.Pools)
 	log.Printf("Monitoring for volume and snapshot events")
 
 	// Initialize with current history (gather initial state, don't report)
 	for _, pool := range w.config.Pools {
-		w.processPoolHistory(pool, true)
+		if err := w.processPoolHistory(ctx, pool, true); err != nil {
+			return err
+		}
+	}
+
+	// Record the datasets to reconcile with later
+	var reconcileTicks <-chan time.Time
+	if w.config.ReconcileInterval > 0 {
+		if err := w.reconcile(ctx); err != nil {
+			return err
+		}
+		reconcileTicker := time.NewTicker(w.config.ReconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcileTicks = reconcileTicker.C
+	}
+
+	// Follow zpool events and accept forwarded events alongside history,
+	// stopping both before returning
+	ctx, cancel := context.WithCancel(ctx)
+	var background sync.WaitGroup
+	defer background.Wait()
+	defer cancel()
+
+	fatal := make(chan error, 1)
+	if runner != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			if err := w.followEvents(ctx, runner); err != nil {
+				fatal <- err
+			}
+		}()
+	}
+	if listener != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			w.serveEvents(ctx, listener)
+		}()
 	}
 
 	// Start periodic checking
 	ticker := time.NewTicker(w.config.Interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-fatal:
+			return err
+		case <-reconcileTicks:
+			if err := w.reconcile(ctx); err != nil {
+				return err
+			}
+			continue
+		case <-ticker.C:
+		}
+
 		for _, pool := range w.config.Pools {
-			w.processPoolHistory(pool, false)
+			if err := w.processPoolHistory(ctx, pool, false); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// Start begins monitoring ZFS changes and only returns on a fatal error
+//
+// Deprecated: use Run, which can be stopped and returns fatal errors.
+func (w *Watcher) Start() {
+	if err := w.Run(context.Background()); err != nil {
+		log.Printf("ZFS watcher stopped: %v", err)
+	}
+}
+
 // GetEventsSince returns events since the specified time
 func (w *Watcher) GetEventsSince(sinceTime time.Time) ([]models.ZFSEvent, error) {
 	var events []models.ZFSEvent
@@ -117,12 +287,12 @@ func (w *Watcher) GetEventsSince(sinceTime time.Time) ([]models.ZFSEvent, error)
 func (w *Watcher) GetEventsSinceEvent(sinceEventCmd string) ([]models.ZFSEvent, error) {
 	var events []models.ZFSEvent
 	var foundEvent bool
+	inv := newInventory()
 
 	for _, pool := range w.config.Pools {
-		cmd := exec.Command(string(w.config.ZpoolCmd), "history", pool)
-		output, err := cmd.Output()
+		output, err := w.readHistory(context.Background(), pool)
 		if err != nil {
-			return nil, fmt.Errorf("error getting history for pool %s: %v", pool, err)
+			return nil, err
 		}
 
 		var poolEvents []models.ZFSEvent
@@ -141,12 +311,14 @@ func (w *Watcher) GetEventsSinceEvent(sinceEventCmd string) ([]models.ZFSEvent,
 
 			// Only collect events after the marker
 			if foundEvent {
-				event, err := w.parseEvent(line, pool)
+				lineEvents, err := w.parseEvents(context.Background(), line, pool, inv)
+				poolEvents = append(poolEvents, inv.takeUnexplained(pool)...)
 				if err == nil {
-					poolEvents = append(poolEvents, event)
+					poolEvents = append(poolEvents, lineEvents...)
 				}
 			}
 		}
+		poolEvents = append(poolEvents, w.staleInternal(pool, inv, true)...)
 
 		events = append(events, poolEvents...)
 	}
@@ -161,11 +333,11 @@ func (w *Watcher) GetEventsSinceEvent(sinceEventCmd string) ([]models.ZFSEvent,
 // getPoolEventsSince returns events for a specific pool since the given time
 func (w *Watcher) getPoolEventsSince(pool string, sinceTime time.Time) ([]models.ZFSEvent, error) {
 	var events []models.ZFSEvent
+	inv := newInventory()
 
-	cmd := exec.Command(string(w.config.ZpoolCmd), "history", pool)
-	output, err := cmd.Output()
+	output, err := w.readHistory(context.Background(), pool)
 	if err != nil {
-		return nil, fmt.Errorf("error getting history for pool %s: %v", pool, err)
+		return nil, err
 	}
 
 	scanner := bufio.NewScanner(strings.NewReader(string(output)))
@@ -175,18 +347,26 @@ func (w *Watcher) getPoolEventsSince(pool string, sinceTime time.Time) ([]models
 			continue
 		}
 
-		event, err := w.parseEvent(line, pool)
+		lineEvents, err := w.parseEvents(context.Background(), line, pool, inv)
+		events = appendSince(events, inv.takeUnexplained(pool), sinceTime)
 		if err != nil {
 			continue
 		}
+		events = appendSince(events, lineEvents, sinceTime)
+	}
+	events = appendSince(events, w.staleInternal(pool, inv, true), sinceTime)
 
-		// Only include events after sinceTime
+	return events, nil
+}
+
+// appendSince appends the events after sinceTime to events
+func appendSince(events []models.ZFSEvent, more []models.ZFSEvent, sinceTime time.Time) []models.ZFSEvent {
+	for _, event := range more {
 		if event.Timestamp.After(sinceTime) {
 			events = append(events, event)
 		}
 	}
-
-	return events, nil
+	return events
 }
 
 // GetRecentEvents returns events from the last duration
@@ -195,151 +375,407 @@ func (w *Watcher) GetRecentEvents(duration time.Duration) ([]models.ZFSEvent, er
 	return w.GetEventsSince(sinceTime)
 }
 
-// processPoolHistory processes the history of a ZFS pool
-func (w *Watcher) processPoolHistory(pool string, initialize bool) {
-	cmd := exec.Command(string(w.config.ZpoolCmd), "history", pool)
-	output, err := cmd.Output()
+// readHistory returns the zpool history output of a pool
+func (w *Watcher) readHistory(ctx context.Context, pool string) ([]byte, error) {
+	args := []string{"history"}
+	if w.config.InternalEvents {
+		args = append(args, "-i")
+	}
+	if w.config.LongFormat {
+		args = append(args, "-l")
+	}
+	output, err := w.config.Runner.Output(ctx, string(w.config.ZpoolCmd), append(args, pool)...)
 	if err != nil {
-		log.Printf("Error getting history for pool %s: %v", pool, err)
-		return
+		return nil, fmt.Errorf("error getting history for pool %s: %w", pool, err)
 	}
+	return output, nil
+}
+
+// processPoolHistory processes the history of a ZFS pool. Failures to read
+// the history are logged and retried on the next poll, only errors that will
+// not go away by themselves are returned.
+func (w *Watcher) processPoolHistory(ctx context.Context, pool string, initialize bool) error {
+	output, err := w.readHistory(ctx, pool)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if isFatal(err) {
+			return err
+		}
+		log.Printf("Error: %v", err)
+		return nil
+	}
+
+	w.processHistoryOutput(ctx, pool, output, initialize)
+	return nil
+}
+
+// isFatal reports whether err means that zpool could not be started at all,
+// as opposed to zpool failing for a single pool
+func isFatal(err error) bool {
+	var execErr *exec.Error
+	var pathErr *fs.PathError
+	return errors.As(err, &execErr) || errors.As(err, &pathErr)
+}
+
+// processHistoryOutput processes the records of a pool's history output that
+// were appended since the previous poll, stopping early if ctx is cancelled
+func (w *Watcher) processHistoryOutput(ctx context.Context, pool string, output []byte, initialize bool) {
+	offset, lost := w.resumeOffset(pool, output)
+	if lost && !initialize {
+		w.dispatch(w.historyGap(pool, output))
+	} else if gap, ok := w.historyJump(pool, output[offset:]); ok && !initialize {
+		w.dispatch(gap)
+	}
+	w.inventory.live = !initialize
+	for offset < len(output) && ctx.Err() == nil {
+		lineOffset := offset
+		line, next := nextLine(output, offset)
+		offset = next
 
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
 		if strings.Contains(line, "History for") || line == "" {
 			continue
 		}
 
+		// The cursor stays on records, as the nvlists zpool history -i
+		// prints below ioctl records are neither unique nor timed
+		if _, ok := recordTime(line); ok {
+			w.advanceCursor(pool, lineOffset, line)
+		}
+
 		// Check if this is the sinceEvent if we're looking for one
 		if !w.seenSinceEvent && w.config.SinceEvent != "" && strings.Contains(line, w.config.SinceEvent) {
 			w.seenSinceEvent = true
 			continue // Skip the marker event itself
 		}
 
-		event, err := w.parseEvent(line, pool)
+		events, err := w.parseEvents(ctx, line, pool, w.inventory)
+
+		// Internal records the command did not explain are records of
+		// their own, reported before it
+		for _, internal := range w.inventory.takeUnexplained(pool) {
+			w.processRecord([]models.ZFSEvent{internal}, initialize)
+		}
 		if err != nil {
 			continue
 		}
+		w.processRecord(events, initialize)
+	}
 
-		// Skip if we've seen this event before
-		lastTime, seen := w.lastEvents[event.Command]
-		if seen && !event.Timestamp.After(lastTime) {
-			continue
+	// Internal records left over at startup are applied to the inventory
+	// like records of the past, instead of being reported by the next poll
+	if ctx.Err() == nil {
+		for _, internal := range w.staleInternal(pool, w.inventory, initialize) {
+			w.processRecord([]models.ZFSEvent{internal}, initialize)
 		}
+	}
+}
 
-		// Skip if before sinceTime
-		if w.config.SinceTime != nil && !event.Timestamp.After(*w.config.SinceTime) {
-			continue
-		}
+// processRecord reports the events of a history record unless they were
+// reported before or are filtered out
+func (w *Watcher) processRecord(events []models.ZFSEvent, initialize bool) {
+	// All events of a record share its command and timestamp
+	event := events[0]
 
-		// Skip if we haven't seen the sinceEvent yet
-		if !w.seenSinceEvent {
-			continue
-		}
+	// Skip if we've seen this event before
+	lastTime, seen := w.lastEvents[event.Command]
+	if seen && !event.Timestamp.After(lastTime) {
+		return
+	}
 
-		// Update last seen time
-		w.lastEvents[event.Command] = event.Timestamp
+	// Skip if before sinceTime
+	if w.config.SinceTime != nil && !event.Timestamp.After(*w.config.SinceTime) {
+		return
+	}
 
-		// Skip reporting events during initialization
-		if initialize {
-			continue
-		}
+	// Skip if we haven't seen the sinceEvent yet
+	if !w.seenSinceEvent {
+		return
+	}
 
-		// Notify handlers
-		for _, handler := range w.eventHandlers {
-			handler(event)
-		}
+	// Update last seen time
+	w.lastEvents[event.Command] = event.Timestamp
+
+	// Skip reporting events during initialization
+	if initialize {
+		return
+	}
+
+	for _, event := range events {
+		w.dispatch(event)
 	}
 }
 
-// parseEvent parses a line from zpool history output
-func (w *Watcher) parseEvent(line string, pool string) (models.ZFSEvent, error) {
-	event := models.ZFSEvent{Pool: pool}
+// dispatch notifies the event handlers of an event
+func (w *Watcher) dispatch(event models.ZFSEvent) {
+	w.dispatchMu.Lock()
+	defer w.dispatchMu.Unlock()
+	w.notify(event)
+}
 
-	// Parse timestamp and command
-	parts := strings.SplitN(line, " ", 2)
-	if len(parts) != 2 {
-		return event, fmt.Errorf("invalid format")
+// notify calls the event handlers with dispatchMu held
+func (w *Watcher) notify(event models.ZFSEvent) {
+	for _, handler := range w.eventHandlers {
+		handler(event)
 	}
+}
 
-	timestamp := parts[0]
-	command := parts[1]
-
-	// Parse the timestamp
-	t, err := time.Parse("2006-01-02.15:04:05", timestamp)
-	if err != nil {
-		return event, fmt.Errorf("invalid timestamp: %v", err)
+// LoggingHandler returns an event handler that logs events
+func LoggingHandler() EventHandler {
+	return func(event models.ZFSEvent) {
+		log.Print(FormatEvent(event))
 	}
-	event.Timestamp = t
-	event.Command = command
+}
+
+// FormatEvent returns a one-line, human readable description of an event,
+// followed by what it was derived from and who ran the command and where,
+// if known
+func FormatEvent(event models.ZFSEvent) string {
+	return describeEvent(event) + formatSource(event) + formatAttribution(event)
+}
 
-	// Try to match different types of events
+// formatSource returns what an event was derived from as e.g.
+// " via channel program snap.lua", or "" for events of a user command
+func formatSource(event models.ZFSEvent) string {
+	switch {
+	case event.Source == models.SourceChannelProgram:
+		return " via channel program " + event.ChannelProgram
+	case event.Internal:
+		return fmt.Sprintf(" (internal, txg %d)", event.TXG)
+	case event.Source == models.SourceReconcile:
+		return " (reconciled)"
+	default:
+		return ""
+	}
+}
 
-	// Check for volume creation
-	if match := w.volumeCreateRE.FindStringSubmatch(command); match != nil {
-		event.Type = models.EventVolumeCreated
-		event.VolumeID = match[3]
-		event.Target = event.VolumeID
-		if match[2] != "" {
-			event.Size = match[2]
+// describeEvent returns the description of an event
+func describeEvent(event models.ZFSEvent) string {
+	timeStr := event.Timestamp.Format("2006-01-02 15:04:05")
+
+	switch event.Type {
+	case models.EventVolumeCreated:
+		return fmt.Sprintf("[%s] Volume created: %s on pool %s%s", timeStr, event.Target, event.Pool, formatEncryption(event.Encryption))
+	case models.EventVolumeDeleted:
+		return fmt.Sprintf("[%s] Volume deleted: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventSnapshotCreated:
+		return fmt.Sprintf("[%s] Snapshot created: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventSnapshotDeleted:
+		return fmt.Sprintf("[%s] Snapshot deleted: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventVolumeResized:
+		return fmt.Sprintf("[%s] Volume resized: %s to %sKB on pool %s", timeStr, event.Target, event.Size, event.Pool)
+	case models.EventFilesystemCreated:
+		return fmt.Sprintf("[%s] Filesystem created: %s on pool %s%s", timeStr, event.Target, event.Pool, formatProperties(event.Properties))
+	case models.EventFilesystemDeleted:
+		return fmt.Sprintf("[%s] Filesystem deleted: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventCloneCreated:
+		return fmt.Sprintf("[%s] Clone created: %s from %s on pool %s", timeStr, event.Target, event.Origin, event.Pool)
+	case models.EventClonePromoted:
+		if event.Origin == "" {
+			return fmt.Sprintf("[%s] Clone promoted: %s on pool %s", timeStr, event.Target, event.Pool)
+		}
+		return fmt.Sprintf("[%s] Clone promoted: %s (was a clone of %s) on pool %s", timeStr, event.Target, event.Origin, event.Pool)
+	case models.EventDatasetRenamed:
+		return fmt.Sprintf("[%s] Dataset renamed: %s to %s on pool %s", timeStr, event.OldTarget, event.NewTarget, event.Pool)
+	case models.EventSnapshotRenamed:
+		return fmt.Sprintf("[%s] Snapshot renamed: %s to %s on pool %s", timeStr, event.OldTarget, event.NewTarget, event.Pool)
+	case models.EventVolumeRolledBack:
+		if len(event.DestroyedClones) > 0 {
+			return fmt.Sprintf("[%s] Volume rolled back: %s on pool %s, destroying snapshots %s and clones %s", timeStr, event.Target, event.Pool, strings.Join(event.DestroyedSnapshots, ", "), strings.Join(event.DestroyedClones, ", "))
+		}
+		if len(event.DestroyedSnapshots) > 0 {
+			return fmt.Sprintf("[%s] Volume rolled back: %s on pool %s, destroying snapshots %s", timeStr, event.Target, event.Pool, strings.Join(event.DestroyedSnapshots, ", "))
 		}
-		return event, nil
-	}
-
-	// Check for volume resize
-	if match := w.volResizeRE.FindStringSubmatch(command); match != nil {
-		event.Type = models.EventVolumeResized
-		event.VolumeID = match[2]
-		event.Target = event.VolumeID
-		event.Size = match[1]
-		return event, nil
-	}
-
-	// Check for snapshot creation
-	if match := w.snapshotRE.FindStringSubmatch(command); match != nil {
-		event.Type = models.EventSnapshotCreated
-		event.VolumeID = match[1]
-		event.SnapshotID = match[2]
-		event.Target = fmt.Sprintf("%s@%s", event.VolumeID, event.SnapshotID)
-		return event, nil
-	}
-
-	// Check for volume/snapshot deletion
-	if match := w.volumeDestroyRE.FindStringSubmatch(command); match != nil {
-		event.VolumeID = match[1]
-		if match[2] != "" {
-			// Snapshot deletion
-			event.Type = models.EventSnapshotDeleted
-			event.SnapshotID = match[2]
-			event.Target = fmt.Sprintf("%s@%s", event.VolumeID, event.SnapshotID)
-		} else {
-			// Volume deletion
-			event.Type = models.EventVolumeDeleted
-			event.Target = event.VolumeID
+		return fmt.Sprintf("[%s] Volume rolled back: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventBookmarkCreated:
+		return fmt.Sprintf("[%s] Bookmark created: %s from %s on pool %s", timeStr, event.Target, event.Origin, event.Pool)
+	case models.EventBookmarkDeleted:
+		return fmt.Sprintf("[%s] Bookmark deleted: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventSnapshotHeld:
+		return fmt.Sprintf("[%s] Snapshot held: %s with tag %s on pool %s", timeStr, event.Target, event.HoldTag, event.Pool)
+	case models.EventSnapshotReleased:
+		return fmt.Sprintf("[%s] Snapshot released: %s from tag %s on pool %s", timeStr, event.Target, event.HoldTag, event.Pool)
+	case models.EventReceived:
+		return fmt.Sprintf("[%s] Stream received: %s on pool %s%s", timeStr, event.Target, event.Pool, formatReceive(event.Receive))
+	case models.EventPoolScrubStarted, models.EventPoolScrubPaused, models.EventPoolScrubStopped,
+		models.EventPoolTrimStarted, models.EventPoolTrimSuspended, models.EventPoolTrimCancelled,
+		models.EventPoolVdevAdded, models.EventPoolDeviceOnline, models.EventPoolDeviceOffline,
+		models.EventPoolImported, models.EventPoolExported, models.EventPoolUpgraded, models.EventPoolCleared:
+		return fmt.Sprintf("[%s] %s: pool %s%s", timeStr, poolEventNames[event.Type], event.Pool, formatDevices(event.Devices))
+	case models.EventPoolDeviceAttached:
+		return fmt.Sprintf("[%s] Device attached: %s to %s on pool %s", timeStr, event.NewDevice, event.Device, event.Pool)
+	case models.EventPoolDeviceDetached:
+		return fmt.Sprintf("[%s] Device detached: %s from pool %s", timeStr, event.Device, event.Pool)
+	case models.EventPoolDeviceReplaced:
+		if event.NewDevice == "" {
+			return fmt.Sprintf("[%s] Device replaced: %s on pool %s", timeStr, event.Device, event.Pool)
 		}
-		return event, nil
+		return fmt.Sprintf("[%s] Device replaced: %s with %s on pool %s", timeStr, event.Device, event.NewDevice, event.Pool)
+	case models.EventKeyLoaded:
+		return fmt.Sprintf("[%s] Key loaded: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventKeyUnloaded:
+		return fmt.Sprintf("[%s] Key unloaded: %s on pool %s", timeStr, event.Target, event.Pool)
+	case models.EventKeyChanged:
+		return fmt.Sprintf("[%s] Key changed: %s on pool %s%s", timeStr, event.Target, event.Pool, formatEncryption(event.Encryption))
+	case models.EventChannelProgramRun:
+		return fmt.Sprintf("[%s] Channel program run: %s on pool %s", timeStr, event.ChannelProgram, event.Pool)
+	case models.EventChecksumError, models.EventIOError, models.EventIODelay, models.EventDeadman, models.EventDataError:
+		return fmt.Sprintf("[%s] %s: %s on pool %s%s", timeStr, zeventNames[event.Type], event.Target, event.Pool, formatVdevErrors(event.Native))
+	case models.EventVdevStateChanged:
+		native := nativeEvent(event)
+		if native.VdevLastState != "" {
+			return fmt.Sprintf("[%s] Vdev state changed: %s from %s to %s on pool %s", timeStr, event.Target, native.VdevLastState, native.VdevState, event.Pool)
+		}
+		return fmt.Sprintf("[%s] Vdev state changed: %s to %s on pool %s", timeStr, event.Target, native.VdevState, event.Pool)
+	case models.EventResilverStarted, models.EventResilverFinished, models.EventScrubFinished:
+		return fmt.Sprintf("[%s] %s: pool %s", timeStr, zeventNames[event.Type], event.Pool)
+	case models.EventHistoryGap:
+		if event.Gap == nil {
+			return fmt.Sprintf("[%s] History gap: pool %s", timeStr, event.Pool)
+		}
+		return fmt.Sprintf("[%s] History gap: pool %s, records from %s to %s may have been dropped unread", timeStr, event.Pool,
+			event.Gap.From.Format("2006-01-02 15:04:05"), event.Gap.To.Format("2006-01-02 15:04:05"))
+	case models.EventNative:
+		return fmt.Sprintf("[%s] ZFS event %s: %s on pool %s", timeStr, nativeEvent(event).Class, event.Target, event.Pool)
+	case models.EventPropertySet:
+		return fmt.Sprintf("[%s] Properties set: %s on pool %s%s", timeStr, event.Target, event.Pool, formatProperties(event.Properties))
+	case models.EventPropertyInherited:
+		return fmt.Sprintf("[%s] Properties inherited: %s on pool %s (%s)", timeStr, event.Target, event.Pool, strings.Join(propertyNames(event.Properties), ", "))
+	default:
+		return fmt.Sprintf("[%s] %s: %s on pool %s", timeStr, event.Type, event.Target, event.Pool)
 	}
+}
 
-	return event, fmt.Errorf("not a matching event")
+// poolEventNames describes the pool events that name the pool and,
+// optionally, a list of devices
+var poolEventNames = map[models.EventType]string{
+	models.EventPoolScrubStarted:  "Scrub started",
+	models.EventPoolScrubPaused:   "Scrub paused",
+	models.EventPoolScrubStopped:  "Scrub stopped",
+	models.EventPoolTrimStarted:   "Trim started",
+	models.EventPoolTrimSuspended: "Trim suspended",
+	models.EventPoolTrimCancelled: "Trim cancelled",
+	models.EventPoolVdevAdded:     "Vdevs added",
+	models.EventPoolDeviceOnline:  "Devices online",
+	models.EventPoolDeviceOffline: "Devices offline",
+	models.EventPoolImported:      "Pool imported",
+	models.EventPoolExported:      "Pool exported",
+	models.EventPoolUpgraded:      "Pool upgraded",
+	models.EventPoolCleared:       "Errors cleared",
 }
 
-// LoggingHandler returns an event handler that logs events
-func LoggingHandler() EventHandler {
-	return func(event models.ZFSEvent) {
-		timeStr := event.Timestamp.Format("2006-01-02 15:04:05")
-
-		switch event.Type {
-		case models.EventVolumeCreated:
-			log.Printf("[%s] Volume created: %s on pool %s", timeStr, event.Target, event.Pool)
-		case models.EventVolumeDeleted:
-			log.Printf("[%s] Volume deleted: %s on pool %s", timeStr, event.Target, event.Pool)
-		case models.EventSnapshotCreated:
-			log.Printf("[%s] Snapshot created: %s on pool %s", timeStr, event.Target, event.Pool)
-		case models.EventSnapshotDeleted:
-			log.Printf("[%s] Snapshot deleted: %s on pool %s", timeStr, event.Target, event.Pool)
-		case models.EventVolumeResized:
-			log.Printf("[%s] Volume resized: %s to %sKB on pool %s", timeStr, event.Target, event.Size, event.Pool)
+// zeventNames describes the events read with zpool events that have a name
+// of their own
+var zeventNames = map[models.EventType]string{
+	models.EventChecksumError:    "Checksum error",
+	models.EventIOError:          "I/O error",
+	models.EventDataError:        "Data error",
+	models.EventIODelay:          "I/O delayed",
+	models.EventDeadman:          "I/O stalled",
+	models.EventResilverStarted:  "Resilver started",
+	models.EventResilverFinished: "Resilver finished",
+	models.EventScrubFinished:    "Scrub finished",
+}
+
+// nativeEvent returns the native description of an event, empty if it has
+// none
+func nativeEvent(event models.ZFSEvent) *models.NativeEvent {
+	if event.Native == nil {
+		return &models.NativeEvent{}
+	}
+	return event.Native
+}
+
+// formatVdevErrors returns the error counts of the vdev of an event as
+// " (read 0, write 0, checksum 2 errors)", or "" if there are none
+func formatVdevErrors(native *models.NativeEvent) string {
+	if native == nil || native.ReadErrors+native.WriteErrors+native.ChecksumErrors == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (read %d, write %d, checksum %d errors)", native.ReadErrors, native.WriteErrors, native.ChecksumErrors)
+}
+
+// formatDevices returns devices as " (dev1 dev2 ...)", or "" if there are
+// none
+func formatDevices(devices []string) string {
+	if len(devices) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(devices, " ") + ")"
+}
+
+// formatEncryption returns the encryption parameters as
+// " (encryption=..., keyformat=...)", or "" if there are none
+func formatEncryption(info *models.EncryptionInfo) string {
+	if info == nil {
+		return ""
+	}
+	if info.Inherited {
+		return " (inherited from parent)"
+	}
+
+	properties := make(map[string]string)
+	for key, value := range map[string]string{
+		"encryption":  info.Algorithm,
+		"keyformat":   info.KeyFormat,
+		"keylocation": info.KeyLocation,
+		"pbkdf2iters": info.PBKDF2Iterations,
+	} {
+		if value != "" {
+			properties[key] = value
 		}
 	}
+	return formatProperties(properties)
+}
+
+// formatReceive returns the stream type and flags of a receive as
+// " (incremental, forced, ...)", or "" if there are none
+func formatReceive(info *models.ReceiveInfo) string {
+	if info == nil {
+		return ""
+	}
+
+	var details []string
+	if info.Stream != "" {
+		details = append(details, strings.ToLower(string(info.Stream)))
+	}
+	if info.Force {
+		details = append(details, "forced")
+	}
+	if info.NoMount {
+		details = append(details, "not mounted")
+	}
+	if info.Resumable {
+		details = append(details, "resumable")
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+// formatProperties returns properties as " (key=value, ...)" in key order,
+// or "" if there are none
+func formatProperties(properties map[string]string) string {
+	if len(properties) == 0 {
+		return ""
+	}
+
+	keys := propertyNames(properties)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+properties[key])
+	}
+	return " (" + strings.Join(pairs, ", ") + ")"
+}
+
+// propertyNames returns the names of properties in order
+func propertyNames(properties map[string]string) []string {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,2059 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+)
+
+// newTestWatcher returns a watcher for pool1 backed by a FakeRunner holding
+// the given history records
+func newTestWatcher(config Config, records ...string) (*Watcher, *FakeRunner) {
+	runner := NewFakeRunner()
+	runner.SetHistory("pool1", records...)
+
+	if config.Pools == nil {
+		config.Pools = []string{"pool1"}
+	}
+	config.Runner = runner
+	return New(config), runner
+}
+
+// collect registers a handler that records every event it receives
+func collect(w *Watcher) *[]models.ZFSEvent {
+	var events []models.ZFSEvent
+	w.AddEventHandler(func(event models.ZFSEvent) {
+		events = append(events, event)
+	})
+	return &events
+}
+
+// targets returns the targets of events in order
+func targets(events []models.ZFSEvent) []string {
+	var result []string
+	for _, event := range events {
+		result = append(result, event.Target)
+	}
+	return result
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []models.ZFSEvent
+		wantErr bool
+	}{
+		{
+			name: "volume create with size",
+			line: "2024-01-01.10:00:00 zfs create -s -V 1048576KB pool1/volume-0a1b-2c3d_1",
+			want: []models.ZFSEvent{{
+				Type:      models.EventVolumeCreated,
+				Target:    "volume-0a1b-2c3d_1",
+				Dataset:   "pool1/volume-0a1b-2c3d_1",
+				VolumeID:  "volume-0a1b-2c3d_1",
+				Size:      "1048576",
+				SizeText:  "1048576KB",
+				SizeBytes: 1 << 30,
+			}},
+		},
+		{
+			name: "filesystem create",
+			line: "2024-01-01.10:00:00 zfs create pool1/volume-0a1b_1",
+			want: []models.ZFSEvent{{
+				Type:     models.EventFilesystemCreated,
+				Target:   "volume-0a1b_1",
+				Dataset:  "pool1/volume-0a1b_1",
+				VolumeID: "volume-0a1b_1",
+			}},
+		},
+		{
+			name: "volume resize",
+			line: "2024-01-01.10:00:00 zfs set volsize=2097152KB pool1/volume-0a1b_1",
+			want: []models.ZFSEvent{{
+				Type:       models.EventPropertySet,
+				Target:     "volume-0a1b_1",
+				Dataset:    "pool1/volume-0a1b_1",
+				VolumeID:   "volume-0a1b_1",
+				Properties: map[string]string{"volsize": "2097152KB"},
+			}, {
+				Type:      models.EventVolumeResized,
+				Target:    "volume-0a1b_1",
+				Dataset:   "pool1/volume-0a1b_1",
+				VolumeID:  "volume-0a1b_1",
+				Size:      "2097152",
+				SizeText:  "2097152KB",
+				SizeBytes: 2 << 30,
+			}},
+		},
+		{
+			name: "snapshot create",
+			line: "2024-01-01.10:00:00 zfs snapshot pool1/volume-0a1b_1@snapshot-9f8e",
+			want: []models.ZFSEvent{{
+				Type:       models.EventSnapshotCreated,
+				Target:     "volume-0a1b_1@snapshot-9f8e",
+				Dataset:    "pool1/volume-0a1b_1",
+				VolumeID:   "volume-0a1b_1",
+				SnapshotID: "snapshot-9f8e",
+			}},
+		},
+		{
+			name: "snapshot destroy",
+			line: "2024-01-01.10:00:00 zfs destroy pool1/volume-0a1b_1@snapshot-9f8e",
+			want: []models.ZFSEvent{{
+				Type:       models.EventSnapshotDeleted,
+				Target:     "volume-0a1b_1@snapshot-9f8e",
+				Dataset:    "pool1/volume-0a1b_1",
+				VolumeID:   "volume-0a1b_1",
+				SnapshotID: "snapshot-9f8e",
+			}},
+		},
+		{
+			name: "volume destroy",
+			line: "2024-01-01.10:00:00 zfs destroy pool1/volume-0a1b_1",
+			want: []models.ZFSEvent{{
+				Type:     models.EventVolumeDeleted,
+				Target:   "volume-0a1b_1",
+				Dataset:  "pool1/volume-0a1b_1",
+				VolumeID: "volume-0a1b_1",
+			}},
+		},
+		{
+			name: "nested dataset on any pool",
+			line: "2024-01-01.10:00:00 zfs create -V 10240KB tank/tenants/acme/disk0",
+			want: []models.ZFSEvent{{
+				Type:      models.EventVolumeCreated,
+				Target:    "tenants/acme/disk0",
+				Dataset:   "tank/tenants/acme/disk0",
+				VolumeID:  "tenants/acme/disk0",
+				Size:      "10240",
+				SizeText:  "10240KB",
+				SizeBytes: 10 << 20,
+			}},
+		},
+		{
+			name: "snapshot with any name",
+			line: "2024-01-01.10:00:00 zfs snapshot tank/vm.disk:0@daily-2024.01.01",
+			want: []models.ZFSEvent{{
+				Type:       models.EventSnapshotCreated,
+				Target:     "vm.disk:0@daily-2024.01.01",
+				Dataset:    "tank/vm.disk:0",
+				VolumeID:   "vm.disk:0",
+				SnapshotID: "daily-2024.01.01",
+			}},
+		},
+		{
+			name: "flags in any order",
+			line: "2024-01-01.10:00:00 zfs create -o volblocksize=16K -V 2048KB -s tank/vol",
+			want: []models.ZFSEvent{{
+				Type:      models.EventVolumeCreated,
+				Target:    "vol",
+				Dataset:   "tank/vol",
+				VolumeID:  "vol",
+				Size:      "2048",
+				SizeText:  "2048KB",
+				SizeBytes: 2 << 20,
+				Properties: map[string]string{
+					"volblocksize": "16K",
+				},
+			}},
+		},
+		{
+			name: "volume create with unit size",
+			line: "2024-01-01.10:00:00 zfs create -V 10G tank/vol",
+			want: []models.ZFSEvent{{
+				Type:      models.EventVolumeCreated,
+				Target:    "vol",
+				Dataset:   "tank/vol",
+				VolumeID:  "vol",
+				Size:      "10485760",
+				SizeText:  "10G",
+				SizeBytes: 10 << 30,
+			}},
+		},
+		{
+			name: "volume resize with fractional size",
+			line: "2024-01-01.10:00:00 zfs set volsize=1.5T pool1/vol",
+			want: []models.ZFSEvent{{
+				Type:       models.EventPropertySet,
+				Target:     "vol",
+				Dataset:    "pool1/vol",
+				VolumeID:   "vol",
+				Properties: map[string]string{"volsize": "1.5T"},
+			}, {
+				Type:      models.EventVolumeResized,
+				Target:    "vol",
+				Dataset:   "pool1/vol",
+				VolumeID:  "vol",
+				Size:      "1610612736",
+				SizeText:  "1.5T",
+				SizeBytes: 3 << 39,
+			}},
+		},
+		{
+			name:    "unrelated command",
+			line:    "2024-01-01.10:00:00 zfs mount -a",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			line:    "yesterday zfs create pool1/volume-0a1b_1",
+			wantErr: true,
+		},
+		{
+			name:    "no command",
+			line:    "2024-01-01.10:00:00",
+			wantErr: true,
+		},
+	}
+
+	w := New(Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := w.parseEvents(context.Background(), tt.line, "pool1", newInventory())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseEvents(%q) succeeded, want error", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEvents(%q) failed: %v", tt.line, err)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("parseEvents(%q) returned %d events, want %d", tt.line, len(events), len(tt.want))
+			}
+			for i, got := range events {
+				if got.ParsedCommand == nil {
+					t.Fatalf("parseEvents(%q) did not set ParsedCommand", tt.line)
+				}
+				got.ParsedCommand = nil
+
+				want := tt.want[i]
+				want.Pool = "pool1"
+				want.UID = -1
+				want.Timestamp = time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+				want.Command = tt.line[len("2024-01-01.10:00:00 "):]
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("parseEvents(%q) event %d = %+v, want %+v", tt.line, i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesystemEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create -V 1024KB pool1/vol",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:01 zfs create -o mountpoint=/srv/nfs -o quota=10G -o recordsize=1M pool1/nfs",
+		"2024-01-01.10:00:02 zfs create pool1/nfs/home",
+		"2024-01-01.10:00:03 zfs destroy pool1/nfs/home",
+		"2024-01-01.10:00:04 zfs destroy pool1/vol",
+		"2024-01-01.10:00:05 zfs destroy pool1/unknown",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []models.EventType{
+		models.EventFilesystemCreated,
+		models.EventFilesystemCreated,
+		models.EventFilesystemDeleted,
+		models.EventVolumeDeleted,
+		models.EventVolumeDeleted,
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d", len(*events), len(want))
+	}
+	for i, event := range *events {
+		if event.Type != want[i] {
+			t.Errorf("event %d (%s) has type %s, want %s", i, event.Target, event.Type, want[i])
+		}
+	}
+
+	properties := map[string]string{"mountpoint": "/srv/nfs", "quota": "10G", "recordsize": "1M"}
+	if got := (*events)[0].Properties; !reflect.DeepEqual(got, properties) {
+		t.Errorf("filesystem created with properties %v, want %v", got, properties)
+	}
+}
+
+func TestCloneEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create -V 1024KB pool1/base",
+		"2024-01-01.10:00:01 zfs snapshot pool1/base@gold",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:02 zfs clone -o com.example:tenant=acme pool1/base@gold pool1/vm1",
+		"2024-01-01.10:00:03 zfs promote pool1/vm1",
+		"2024-01-01.10:00:04 zfs destroy pool1/base",
+		"2024-01-01.10:00:05 zfs clone pool1/vm1@gold pool1/vm2",
+		"2024-01-01.10:00:06 zfs destroy pool1/vm2",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	if len(*events) != 5 {
+		t.Fatalf("poll reported %d events, want 5: %v", len(*events), targets(*events))
+	}
+
+	clone := (*events)[0]
+	if clone.Type != models.EventCloneCreated || clone.Dataset != "pool1/vm1" || clone.Origin != "pool1/base@gold" {
+		t.Errorf("clone reported as %s of %s from %q", clone.Type, clone.Dataset, clone.Origin)
+	}
+	if clone.Properties["com.example:tenant"] != "acme" {
+		t.Errorf("clone properties = %v, want the -o property", clone.Properties)
+	}
+
+	promote := (*events)[1]
+	if promote.Type != models.EventClonePromoted || promote.Dataset != "pool1/vm1" || promote.Origin != "pool1/base@gold" {
+		t.Errorf("promote reported as %s of %s from %q", promote.Type, promote.Dataset, promote.Origin)
+	}
+
+	if base := (*events)[2]; base.Type != models.EventVolumeDeleted || base.Dataset != "pool1/base" {
+		t.Errorf("destroy of the former origin reported as %s of %s", base.Type, base.Dataset)
+	}
+
+	// The clone of a volume is a volume, and is reported as one
+	if kind, ok := w.inventory.kind("pool1/vm1"); !ok || kind != datasetVolume {
+		t.Errorf("clone recorded as %q, %v, want a volume", kind, ok)
+	}
+	if destroy := (*events)[4]; destroy.Type != models.EventVolumeDeleted || destroy.Dataset != "pool1/vm2" {
+		t.Errorf("destroy of a volume clone reported as %s of %s, want %s", destroy.Type, destroy.Dataset, models.EventVolumeDeleted)
+	}
+	if origin, _ := w.inventory.origin("pool1/vm1"); origin != "" {
+		t.Errorf("promoted clone still has origin %q", origin)
+	}
+}
+
+func TestRenameEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create pool1/tenant",
+		"2024-01-01.10:00:01 zfs create -V 1024KB pool1/tenant/disk0",
+		"2024-01-01.10:00:02 zfs create -V 1024KB pool1/tenant/disk1",
+		"2024-01-01.10:00:03 zfs snapshot -r pool1/tenant@daily",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:05 zfs rename -r pool1/tenant@daily @monday",
+		"2024-01-01.10:00:06 zfs rename pool1/tenant/disk1@monday tuesday",
+		"2024-01-01.10:00:07 zfs rename -p pool1/tenant pool1/customers/acme",
+		"2024-01-01.10:00:08 zfs rename pool1/customers/acme/disk0@monday pool1/customers/acme/disk0@weekly",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type rename struct {
+		typ      models.EventType
+		old, new string
+	}
+	want := []rename{
+		{models.EventSnapshotRenamed, "tenant@daily", "tenant@monday"},
+		{models.EventSnapshotRenamed, "tenant/disk0@daily", "tenant/disk0@monday"},
+		{models.EventSnapshotRenamed, "tenant/disk1@daily", "tenant/disk1@monday"},
+		{models.EventSnapshotRenamed, "tenant/disk1@monday", "tenant/disk1@tuesday"},
+		{models.EventDatasetRenamed, "tenant", "customers/acme"},
+		{models.EventSnapshotRenamed, "customers/acme/disk0@monday", "customers/acme/disk0@weekly"},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := rename{event.Type, event.OldTarget, event.NewTarget}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	// The children moved with their parent
+	if !w.inventory.hasSnapshot("pool1/customers/acme/disk1", "tuesday") {
+		t.Error("inventory did not follow the rename of pool1/tenant")
+	}
+}
+
+func TestBookmarkEvents(t *testing.T) {
+	w := New(Config{})
+
+	tests := []struct {
+		line     string
+		typ      models.EventType
+		target   string
+		bookmark string
+		origin   string
+	}{
+		{"2024-01-01.10:00:00 zfs bookmark tank/vol@snap tank/vol#repl-1", models.EventBookmarkCreated, "vol#repl-1", "repl-1", "tank/vol@snap"},
+		{"2024-01-01.10:00:00 zfs bookmark tank/vol#repl-1 #repl-2", models.EventBookmarkCreated, "vol#repl-2", "repl-2", "tank/vol#repl-1"},
+		{"2024-01-01.10:00:00 zfs destroy tank/vol#repl-1", models.EventBookmarkDeleted, "vol#repl-1", "repl-1", ""},
+	}
+	for _, tt := range tests {
+		events, err := w.parseEvents(context.Background(), tt.line, "tank", newInventory())
+		if err != nil {
+			t.Errorf("parseEvents(%q) failed: %v", tt.line, err)
+			continue
+		}
+		got := events[0]
+		if len(events) != 1 || got.Type != tt.typ || got.Target != tt.target || got.BookmarkID != tt.bookmark ||
+			got.Dataset != "tank/vol" || got.Origin != tt.origin {
+			t.Errorf("parseEvents(%q) = %+v", tt.line, events)
+		}
+	}
+
+	if _, err := w.parseEvents(context.Background(), "2024-01-01.10:00:00 zfs bookmark tank/vol tank/vol#mark", "tank", newInventory()); err == nil {
+		t.Error("bookmark of a dataset was reported")
+	}
+}
+
+func TestHoldEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true},
+		"2024-01-01.10:00:00 zfs create pool1/tenant",
+		"2024-01-01.10:00:01 zfs create -V 1G pool1/tenant/disk0",
+		"2024-01-01.10:00:02 zfs snapshot -r pool1/tenant@daily",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:03 zfs hold -r backup pool1/tenant@daily",
+		"2024-01-01.10:00:04 zfs release backup pool1/tenant/disk0@daily",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type hold struct {
+		typ       models.EventType
+		target    string
+		tag       string
+		recursive bool
+	}
+	want := []hold{
+		{models.EventSnapshotHeld, "tenant@daily", "backup", true},
+		{models.EventSnapshotHeld, "tenant/disk0@daily", "backup", true},
+		{models.EventSnapshotReleased, "tenant/disk0@daily", "backup", false},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := hold{event.Type, event.Target, event.HoldTag, event.Recursive}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestReceiveEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/empty",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:01 zfs receive -u -x mountpoint pool1/replica@monday",
+		"2024-01-01.10:00:02 zfs recv -F -s pool1/replica",
+		"2024-01-01.10:00:03 zfs receive -F pool1/empty",
+		"2024-01-01.10:00:04 zfs receive -d pool1/backups",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []struct {
+		target string
+		info   models.ReceiveInfo
+	}{
+		{"replica@monday", models.ReceiveInfo{NoMount: true, Excluded: []string{"mountpoint"}}},
+		{"replica", models.ReceiveInfo{Stream: models.StreamIncremental, Force: true, Resumable: true}},
+		{"empty", models.ReceiveInfo{Stream: models.StreamFull, Force: true}},
+		{"backups", models.ReceiveInfo{NameFromStream: true}},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		if event.Type != models.EventReceived || event.Target != want[i].target || event.Receive == nil ||
+			!reflect.DeepEqual(*event.Receive, want[i].info) {
+			t.Errorf("event %d = %s %s %+v, want %s %+v", i, event.Type, event.Target, event.Receive, want[i].target, want[i].info)
+		}
+	}
+
+	// The dataset a full stream created is known, a replaced one keeps its type
+	if kind, ok := w.inventory.kind("pool1/replica"); !ok || kind != datasetUnknown {
+		t.Errorf("received dataset recorded as %q, %v", kind, ok)
+	}
+	if kind, _ := w.inventory.kind("pool1/empty"); kind != datasetVolume {
+		t.Errorf("replaced volume recorded as %q", kind)
+	}
+}
+
+func TestPoolEvents(t *testing.T) {
+	w := New(Config{Naming: CinderNaming()})
+
+	tests := []struct {
+		line string
+		want models.ZFSEvent
+	}{
+		{"zpool scrub pool1", models.ZFSEvent{Type: models.EventPoolScrubStarted}},
+		{"zpool scrub -p pool1", models.ZFSEvent{Type: models.EventPoolScrubPaused}},
+		{"zpool scrub -s pool1", models.ZFSEvent{Type: models.EventPoolScrubStopped}},
+		{"zpool trim -r 100M pool1 sda", models.ZFSEvent{Type: models.EventPoolTrimStarted, Devices: []string{"sda"}}},
+		{"zpool trim -c pool1", models.ZFSEvent{Type: models.EventPoolTrimCancelled}},
+		{"zpool add -f pool1 mirror sdc sdd log sde", models.ZFSEvent{Type: models.EventPoolVdevAdded, Devices: []string{"mirror", "sdc", "sdd", "log", "sde"}}},
+		{"zpool attach pool1 sda sdb", models.ZFSEvent{Type: models.EventPoolDeviceAttached, Device: "sda", NewDevice: "sdb"}},
+		{"zpool detach pool1 sdb", models.ZFSEvent{Type: models.EventPoolDeviceDetached, Device: "sdb"}},
+		{"zpool replace -o ashift=12 pool1 sda sdf", models.ZFSEvent{Type: models.EventPoolDeviceReplaced, Device: "sda", NewDevice: "sdf", Properties: map[string]string{"ashift": "12"}}},
+		{"zpool replace pool1 sda", models.ZFSEvent{Type: models.EventPoolDeviceReplaced, Device: "sda"}},
+		{"zpool offline -t pool1 sda sdb", models.ZFSEvent{Type: models.EventPoolDeviceOffline, Devices: []string{"sda", "sdb"}}},
+		{"zpool online -e pool1 sda", models.ZFSEvent{Type: models.EventPoolDeviceOnline, Devices: []string{"sda"}}},
+		{"zpool import -c /etc/zfs/zpool.cache -aN", models.ZFSEvent{Type: models.EventPoolImported}},
+		{"zpool export pool1", models.ZFSEvent{Type: models.EventPoolExported}},
+		{"zpool upgrade pool1", models.ZFSEvent{Type: models.EventPoolUpgraded}},
+		{"zpool clear pool1 sda", models.ZFSEvent{Type: models.EventPoolCleared, Devices: []string{"sda"}}},
+	}
+	for _, tt := range tests {
+		line := "2024-01-01.10:00:00 " + tt.line
+		events, err := w.parseEvents(context.Background(), line, "pool1", newInventory())
+		if err != nil {
+			t.Errorf("parseEvents(%q) failed: %v", line, err)
+			continue
+		}
+		got := events[0]
+		got.ParsedCommand = nil
+
+		tt.want.Pool = "pool1"
+		tt.want.UID = -1
+		tt.want.Target = "pool1"
+		tt.want.Timestamp = time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+		tt.want.Command = tt.line
+		if len(events) != 1 || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEvents(%q) = %+v, want %+v", line, events, tt.want)
+		}
+	}
+
+	if _, err := w.parseEvents(context.Background(), "2024-01-01.10:00:00 zpool attach pool1 sda", "pool1", newInventory()); err == nil {
+		t.Error("attach without a new device was reported")
+	}
+}
+
+func TestEncryptionEvents(t *testing.T) {
+	w := New(Config{})
+
+	tests := []struct {
+		line       string
+		typ        models.EventType
+		targets    []string
+		encryption *models.EncryptionInfo
+	}{
+		{
+			"zfs create -V 1G -o encryption=aes-256-gcm -o keyformat=passphrase -o keylocation=prompt tank/secure",
+			models.EventVolumeCreated, []string{"secure"},
+			&models.EncryptionInfo{Algorithm: "aes-256-gcm", KeyFormat: "passphrase", KeyLocation: "prompt"},
+		},
+		{"zfs create tank/plain", models.EventFilesystemCreated, []string{"plain"}, nil},
+		{"zfs load-key -r -L file:///etc/zfs/tank.key tank/secure tank/other", models.EventKeyLoaded, []string{"secure", "other"}, nil},
+		{"zfs load-key -a", models.EventKeyLoaded, []string{"tank"}, nil},
+		{"zfs unload-key tank/secure", models.EventKeyUnloaded, []string{"secure"}, nil},
+		{
+			"zfs change-key -l -o keyformat=raw -o keylocation=file:///etc/zfs/new.key tank/secure",
+			models.EventKeyChanged, []string{"secure"},
+			&models.EncryptionInfo{KeyFormat: "raw", KeyLocation: "file:///etc/zfs/new.key"},
+		},
+		{"zfs change-key -i tank/secure/child", models.EventKeyChanged, []string{"secure/child"}, &models.EncryptionInfo{Inherited: true}},
+	}
+	for _, tt := range tests {
+		events, err := w.parseEvents(context.Background(), "2024-01-01.10:00:00 "+tt.line, "tank", newInventory())
+		if err != nil {
+			t.Errorf("parseEvents(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !equalStrings(targets(events), tt.targets) {
+			t.Errorf("parseEvents(%q) reported %v, want %v", tt.line, targets(events), tt.targets)
+			continue
+		}
+		if events[0].Type != tt.typ || !reflect.DeepEqual(events[0].Encryption, tt.encryption) {
+			t.Errorf("parseEvents(%q) = %s %+v, want %s %+v", tt.line, events[0].Type, events[0].Encryption, tt.typ, tt.encryption)
+		}
+	}
+
+	event := models.ZFSEvent{Type: models.EventKeyChanged, Target: "secure", Pool: "tank", Encryption: &models.EncryptionInfo{KeyFormat: "raw"}}
+	if got, want := FormatEvent(event), "Key changed: secure on pool tank (keyformat=raw)"; !strings.HasSuffix(got, want) {
+		t.Errorf("FormatEvent = %q, want suffix %q", got, want)
+	}
+}
+
+func TestPropertyEvents(t *testing.T) {
+	w := New(Config{})
+
+	events, err := w.parseEvents(context.Background(), "2024-01-01.10:00:00 zfs set compression=lz4 com.example:tenant=acme tank/a tank/b@s1", "tank", newInventory())
+	if err != nil {
+		t.Fatalf("parseEvents failed: %v", err)
+	}
+	if want := []string{"a", "b@s1"}; !equalStrings(targets(events), want) {
+		t.Fatalf("zfs set reported %v, want %v", targets(events), want)
+	}
+	properties := map[string]string{"compression": "lz4", "com.example:tenant": "acme"}
+	for _, event := range events {
+		if event.Type != models.EventPropertySet || !reflect.DeepEqual(event.Properties, properties) {
+			t.Errorf("zfs set reported %+v, want properties %v", event, properties)
+		}
+	}
+
+	events, err = w.parseEvents(context.Background(), "2024-01-01.10:00:00 zfs set volsize=2048KB tank/vol", "tank", newInventory())
+	if err != nil {
+		t.Fatalf("parseEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != models.EventPropertySet || events[1].Type != models.EventVolumeResized {
+		t.Fatalf("zfs set volsize reported %+v, want a property and a resize event", events)
+	}
+
+	events, err = w.parseEvents(context.Background(), "2024-01-01.10:00:00 zfs inherit -r quota tank/a", "tank", newInventory())
+	if err != nil {
+		t.Fatalf("parseEvents failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != models.EventPropertyInherited || !events[0].Recursive ||
+		!reflect.DeepEqual(events[0].Properties, map[string]string{"quota": ""}) {
+		t.Errorf("zfs inherit reported %+v", events)
+	}
+}
+
+func TestPropertyEventsUnquoted(t *testing.T) {
+	// History does not quote arguments, so quotes and backslashes are part of
+	// the values and values may contain spaces
+	tests := []struct {
+		line  string
+		value string
+	}{
+		{"2024-01-01.10:00:00 zfs set com.example:note=it's pool1/vol", "it's"},
+		{"2024-01-01.10:00:00 zfs set com.example:note=a b pool1/vol", "a b"},
+		{`2024-01-01.10:00:00 zfs set com.example:note=C:\x pool1/vol`, `C:\x`},
+		{"2024-01-01.10:00:00 zfs create -o com.example:note=tenant disk -V 10G pool1/vol", "tenant disk"},
+		{"2024-01-01.10:00:00 zfs clone -o com.example:note=a b pool1/src@s pool1/vol", "a b"},
+	}
+
+	w := New(Config{})
+	for _, tt := range tests {
+		events, err := w.parseEvents(context.Background(), tt.line, "pool1", newInventory())
+		if err != nil {
+			t.Errorf("parseEvents(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if len(events) != 1 || events[0].Dataset != "pool1/vol" || events[0].Properties["com.example:note"] != tt.value {
+			t.Errorf("parseEvents(%q) = %+v, want com.example:note=%s set on pool1/vol", tt.line, events, tt.value)
+		}
+	}
+}
+
+func TestRollbackEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create -V 1024KB pool1/vol",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol@a",
+		"2024-01-01.10:00:02 zfs snapshot pool1/vol@b",
+		"2024-01-01.10:00:03 zfs snapshot pool1/vol@c",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:04 zfs rollback pool1/vol@c",
+		"2024-01-01.10:00:05 zfs rollback -r pool1/vol@a",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	if len(*events) != 2 {
+		t.Fatalf("poll reported %d events, want 2", len(*events))
+	}
+
+	latest := (*events)[0]
+	if latest.Type != models.EventVolumeRolledBack || latest.Target != "vol@c" || latest.Recursive || len(latest.DestroyedSnapshots) != 0 {
+		t.Errorf("rollback to latest = %+v", latest)
+	}
+
+	recursive := (*events)[1]
+	if recursive.Target != "vol@a" || recursive.SnapshotID != "a" || !recursive.Recursive || recursive.RecursiveClones {
+		t.Errorf("recursive rollback = %+v", recursive)
+	}
+	if want := []string{"b", "c"}; !equalStrings(recursive.DestroyedSnapshots, want) {
+		t.Errorf("recursive rollback destroyed %v, want %v", recursive.DestroyedSnapshots, want)
+	}
+}
+
+func TestRollbackDestroysClones(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol@a",
+		"2024-01-01.10:00:02 zfs snapshot pool1/vol@b",
+		"2024-01-01.10:00:03 zfs clone pool1/vol@b pool1/vm1",
+		"2024-01-01.10:00:04 zfs snapshot pool1/vm1@s1",
+		"2024-01-01.10:00:05 zfs clone pool1/vm1@s1 pool1/vm2",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// -R destroys the clones of the snapshots it destroys
+	runner.AppendHistory("pool1", "2024-01-01.10:00:06 zfs rollback -R pool1/vol@a")
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	if len(*events) != 3 {
+		t.Fatalf("poll reported %d events, want 3: %v", len(*events), targets(*events))
+	}
+
+	// The clone of the clone is destroyed with it, as by zfs destroy -R
+	rollback := (*events)[0]
+	if !rollback.Recursive || !rollback.RecursiveClones {
+		t.Errorf("rollback -R has Recursive %v and RecursiveClones %v, want both", rollback.Recursive, rollback.RecursiveClones)
+	}
+	if !equalStrings(rollback.DestroyedSnapshots, []string{"b"}) || !equalStrings(rollback.DestroyedClones, []string{"pool1/vm1"}) {
+		t.Errorf("rollback destroyed snapshots %v and clones %v", rollback.DestroyedSnapshots, rollback.DestroyedClones)
+	}
+
+	type deletion struct {
+		typ            models.EventType
+		target, parent string
+	}
+	want := []deletion{
+		{models.EventVolumeDeleted, "vm1", "pool1/vol@a"},
+		{models.EventVolumeDeleted, "vm2", "pool1/vol@a"},
+	}
+	for i, event := range (*events)[1:] {
+		if got := (deletion{event.Type, event.Target, event.RecursiveParent}); got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i+1, got, want[i])
+		}
+	}
+
+	for _, clone := range []string{"pool1/vm1", "pool1/vm2"} {
+		if _, ok := w.inventory.kind(clone); ok {
+			t.Errorf("destroyed clone %s is still in the inventory", clone)
+		}
+	}
+}
+
+func TestRecursiveEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true},
+		"2024-01-01.10:00:00 zfs create pool1/tenant",
+		"2024-01-01.10:00:01 zfs create -V 1G pool1/tenant/disk0",
+		"2024-01-01.10:00:02 zfs create -V 1G pool1/tenant/disk1",
+		"2024-01-01.10:00:03 zfs snapshot pool1/tenant/disk0@gold",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:04 zfs snapshot -r pool1/tenant@daily",
+		"2024-01-01.10:00:05 zfs destroy -r pool1/tenant@daily",
+		"2024-01-01.10:00:06 zfs clone pool1/tenant/disk0@gold pool1/vm1",
+		"2024-01-01.10:00:07 zfs destroy -R pool1/tenant",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type result struct {
+		typ    models.EventType
+		target string
+		parent string
+	}
+	want := []result{
+		{models.EventSnapshotCreated, "tenant@daily", ""},
+		{models.EventSnapshotCreated, "tenant/disk0@daily", "pool1/tenant@daily"},
+		{models.EventSnapshotCreated, "tenant/disk1@daily", "pool1/tenant@daily"},
+		{models.EventSnapshotDeleted, "tenant@daily", ""},
+		{models.EventSnapshotDeleted, "tenant/disk0@daily", "pool1/tenant@daily"},
+		{models.EventSnapshotDeleted, "tenant/disk1@daily", "pool1/tenant@daily"},
+		{models.EventCloneCreated, "vm1", ""},
+		{models.EventFilesystemDeleted, "tenant", ""},
+		{models.EventVolumeDeleted, "tenant/disk0", "pool1/tenant"},
+		{models.EventVolumeDeleted, "tenant/disk1", "pool1/tenant"},
+		{models.EventVolumeDeleted, "vm1", "pool1/tenant"},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := result{event.Type, event.Target, event.RecursiveParent}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+		if event.Type != models.EventCloneCreated && !event.Recursive {
+			t.Errorf("event %d (%s) is not marked recursive", i, event.Target)
+		}
+		if clones := i >= 7; event.RecursiveClones != clones {
+			t.Errorf("event %d (%s) has RecursiveClones %v, want %v", i, event.Target, event.RecursiveClones, clones)
+		}
+	}
+
+	if _, ok := w.inventory.kind("pool1/vm1"); ok {
+		t.Error("clone destroyed with -R is still in the inventory")
+	}
+}
+
+func TestRecursiveEventsNotExpanded(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create pool1/tenant",
+		"2024-01-01.10:00:01 zfs create -V 1G pool1/tenant/disk0",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1", "2024-01-01.10:00:02 zfs snapshot -r pool1/tenant@daily")
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	if want := []string{"tenant@daily"}; !equalStrings(targets(*events), want) || !(*events)[0].Recursive {
+		t.Fatalf("poll reported %+v, want a single recursive event for %v", *events, want)
+	}
+
+	// The descendants are snapshotted all the same
+	if !w.inventory.hasSnapshot("pool1/tenant/disk0", "daily") {
+		t.Error("inventory did not record the snapshot of the descendant")
+	}
+}
+
+func TestRecursiveEventsListDescendants(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true, ListDescendants: true, ZpoolCmd: ZpoolCmdUsrSbin})
+	runner.SetOutput("pool1/legacy\tfilesystem\npool1/legacy/disk0\tvolume\n",
+		"/usr/sbin/zfs", "list", "-H", "-o", "name,type", "-r", "-t", "filesystem,volume", "pool1/legacy")
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:00 zfs snapshot -r pool1/legacy@daily",
+		"2024-01-01.10:00:01 zfs snapshot -r pool1/legacy@weekly",
+		"2024-01-01.10:00:02 zfs destroy -r pool1/legacy",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"legacy@daily", "legacy/disk0@daily", "legacy@weekly", "legacy/disk0@weekly", "legacy", "legacy/disk0"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+	if (*events)[4].Type != models.EventFilesystemDeleted || (*events)[5].Type != models.EventVolumeDeleted {
+		t.Errorf("listed datasets reported as %s and %s", (*events)[4].Type, (*events)[5].Type)
+	}
+
+	// Each dataset is listed once
+	lists := 0
+	for _, call := range runner.Calls() {
+		if strings.HasPrefix(call, "zfs list") {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("zfs list was run %d times, want 1", lists)
+	}
+}
+
+func TestListDescendantsOnlyWhenFollowing(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true, ListDescendants: true, ZpoolCmd: ZpoolCmdUsrSbin},
+		"2024-01-01.10:00:00 zfs snapshot -r pool1/legacy@old",
+	)
+	events := collect(w)
+	lists := func() int {
+		n := 0
+		for _, call := range runner.Calls() {
+			if strings.HasPrefix(call, "zfs list") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// zfs list shows what exists now, not what existed at the time of the
+	// history read at startup
+	w.processPoolHistory(context.Background(), "pool1", true)
+	if n := lists(); n != 0 {
+		t.Fatalf("zfs list was run %d times during initialization", n)
+	}
+
+	// A failed listing is retried by the next recursive command
+	runner.AppendHistory("pool1", "2024-01-01.10:00:01 zfs snapshot -r pool1/legacy@daily")
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	runner.SetOutput("pool1/legacy\tfilesystem\npool1/legacy/disk0\tvolume\n",
+		"/usr/sbin/zfs", "list", "-H", "-o", "name,type", "-r", "-t", "filesystem,volume", "pool1/legacy")
+	runner.AppendHistory("pool1", "2024-01-01.10:00:02 zfs snapshot -r pool1/legacy@weekly")
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"legacy@daily", "legacy@weekly", "legacy/disk0@weekly"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Errorf("poll reported %v, want %v", got, want)
+	}
+	if n := lists(); n != 2 {
+		t.Errorf("zfs list was run %d times, want 2", n)
+	}
+}
+
+func TestSnapshotListDestroy(t *testing.T) {
+	w, runner := newTestWatcher(Config{ExpandRecursive: true},
+		"2024-01-01.10:00:00 zfs create pool1/tenant",
+		"2024-01-01.10:00:01 zfs create -V 1G pool1/tenant/disk0",
+		"2024-01-01.10:00:02 zfs snapshot -r pool1/tenant@a",
+		"2024-01-01.10:00:03 zfs snapshot -r pool1/tenant@b",
+		"2024-01-01.10:00:04 zfs snapshot -r pool1/tenant@c",
+		"2024-01-01.10:00:05 zfs snapshot pool1/tenant@d",
+		"2024-01-01.10:00:06 zfs snapshot -r pool1/tenant@e",
+		"2024-01-01.10:00:07 zfs snapshot -r pool1/tenant@f",
+		"2024-01-01.10:00:08 zfs clone pool1/tenant/disk0@e pool1/vm1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:09 zfs destroy pool1/tenant@a,b",
+		"2024-01-01.10:00:10 zfs destroy -r pool1/tenant@%c",
+		"2024-01-01.10:00:11 zfs destroy pool1/tenant@f%d",
+		"2024-01-01.10:00:12 zfs destroy pool1/tenant@x%y",
+		"2024-01-01.10:00:13 zfs destroy -R pool1/tenant@e%,f",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{
+		"tenant@a", "tenant@b",
+		"tenant@c", "tenant/disk0@a", "tenant/disk0@b", "tenant/disk0@c",
+		"tenant@x%y",
+		"tenant@e", "tenant@f", "tenant/disk0@e", "tenant/disk0@f", "vm1",
+	}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+	for _, event := range *events {
+		if event.Target != "vm1" && event.Type != models.EventSnapshotDeleted {
+			t.Errorf("%s reported as %s", event.Target, event.Type)
+		}
+	}
+	if parent := (*events)[3].RecursiveParent; parent != "pool1/tenant@%c" {
+		t.Errorf("range destroy derived from %q, want the operand", parent)
+	}
+
+	// A range with unknown ends is reported as given, as the snapshots
+	// between them are not known, and a reversed range destroys nothing
+	if unknown := (*events)[6]; unknown.Dataset != "pool1/tenant" || unknown.SnapshotID != "x%y" {
+		t.Errorf("range with unknown ends reported as %+v", unknown)
+	}
+
+	if snapshots := w.inventory.snapshots["pool1/tenant"]; !equalStrings(snapshots, []string{"d"}) {
+		t.Errorf("inventory has snapshots %v, want [d]", snapshots)
+	}
+}
+
+func TestInternalEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{InternalEvents: true},
+		"2024-01-01.10:00:00 [txg:4] open pool version 5000; software version zfs-2.2.2; uts host 6.1.0 #1 SMP x86_64",
+		"2024-01-01.10:00:00 [txg:99] create pool1/vol (54) ",
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:01 [txg:100] snapshot pool1/vol@a (768) ",
+		"2024-01-01.10:00:01 ioctl snapshot",
+		"    input:",
+		"        snaps:",
+		"            pool1/vol@a",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol@a",
+		"2024-01-01.10:00:02 [txg:101] destroy pool1/vol@b (770) ",
+		"2024-01-01.10:00:02 [txg:101] set pool1/other (60) com.example:x=1",
+		"2024-01-01.10:00:03 [txg:102] set pool1/vol (54) volsize=2147483648",
+		"2024-01-01.10:00:03 zfs set volsize=2G pool1/vol",
+		"2024-01-01.10:00:04 [txg:103] snapshot pool1/vol@zed (800) ",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type internal struct {
+		typ      models.EventType
+		target   string
+		txg      uint64
+		objectID uint64
+		internal bool
+	}
+	want := []internal{
+		{models.EventSnapshotCreated, "vol@a", 100, 768, false},
+		{models.EventSnapshotDeleted, "vol@b", 101, 770, true},
+		{models.EventPropertySet, "other", 101, 60, true},
+		{models.EventPropertySet, "vol", 102, 54, false},
+		{models.EventVolumeResized, "vol", 102, 54, false},
+	}
+	check := func() {
+		t.Helper()
+		if len(*events) != len(want) {
+			t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+		}
+		for i, event := range *events {
+			got := internal{event.Type, event.Target, event.TXG, event.ObjectID, event.Internal}
+			if got != want[i] {
+				t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+			}
+		}
+	}
+	check()
+
+	// A record no command explains is reported after a poll
+	w.processPoolHistory(context.Background(), "pool1", false)
+	want = append(want, internal{models.EventSnapshotCreated, "vol@zed", 103, 800, true})
+	check()
+
+	if calls := runner.Calls(); calls[0] != "zpool history -i pool1" {
+		t.Errorf("history read with %q, want -i", calls[0])
+	}
+}
+
+func TestInternalEventsAtStartup(t *testing.T) {
+	w, _ := newTestWatcher(Config{InternalEvents: true},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol@x",
+		"2024-01-01.10:00:02 [txg:200] destroy pool1/vol@x (768) ",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// The trailing record is history read at startup, not a new event
+	if w.inventory.hasSnapshot("pool1/vol", "x") {
+		t.Error("record read at startup was not applied to the inventory")
+	}
+	w.processPoolHistory(context.Background(), "pool1", false)
+	if len(*events) != 0 {
+		t.Errorf("poll without new history reported %v", targets(*events))
+	}
+}
+
+func TestChannelProgramEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{InternalEvents: true},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol@old",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:02 [txg:200] destroy pool1/other@x (900) ",
+		"2024-01-01.10:00:03 [txg:201] snapshot pool1/vol@new (901) ",
+		"2024-01-01.10:00:03 [txg:201] destroy pool1/vol@old (850) ",
+		"2024-01-01.10:00:03 ioctl channel_program",
+		"    input:",
+		"        program: <redacted>",
+		"2024-01-01.10:00:03 zfs program -t 1000 pool1 /etc/zfs/rotate.lua pool1/vol",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type program struct {
+		typ    models.EventType
+		target string
+		source models.EventSource
+		script string
+		txg    uint64
+	}
+	want := []program{
+		{models.EventSnapshotDeleted, "other@x", "", "", 200},
+		{models.EventChannelProgramRun, "pool1", "", "/etc/zfs/rotate.lua", 0},
+		{models.EventSnapshotCreated, "vol@new", models.SourceChannelProgram, "/etc/zfs/rotate.lua", 201},
+		{models.EventSnapshotDeleted, "vol@old", models.SourceChannelProgram, "/etc/zfs/rotate.lua", 201},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := program{event.Type, event.Target, event.Source, event.ChannelProgram, event.TXG}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if effect := (*events)[2]; effect.Internal || effect.ParsedCommand == nil || effect.ParsedCommand.Subcommand != "program" {
+		t.Errorf("synthesized event = %+v, want it attributed to the zfs program command", effect)
+	}
+	if got, want := FormatEvent((*events)[2]), "via channel program /etc/zfs/rotate.lua"; !strings.HasSuffix(got, want) {
+		t.Errorf("FormatEvent = %q, want suffix %q", got, want)
+	}
+
+	if w.inventory.hasSnapshot("pool1/vol", "old") || !w.inventory.hasSnapshot("pool1/vol", "new") {
+		t.Errorf("inventory has snapshots %v, want [new]", w.inventory.snapshots["pool1/vol"])
+	}
+}
+
+func TestChannelProgramWithoutChanges(t *testing.T) {
+	w, runner := newTestWatcher(Config{InternalEvents: true},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// Records written before the program ran, or taken by another user
+	// command in between, are not the program's
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:01 [txg:300] snapshot pool1/vol@zed (902) ",
+		"2024-01-01.10:00:02 zfs program pool1 /etc/zfs/noop.lua",
+		"2024-01-01.10:00:03 [txg:301] snapshot pool1/vol@manual (903) ",
+		"2024-01-01.10:00:03 zfs snapshot pool1/vol@manual",
+		"2024-01-01.10:00:03 zfs program pool1 /etc/zfs/check.lua",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type program struct {
+		typ    models.EventType
+		target string
+		source models.EventSource
+		txg    uint64
+	}
+	want := []program{
+		{models.EventSnapshotCreated, "vol@zed", "", 300},
+		{models.EventChannelProgramRun, "pool1", "", 0},
+		{models.EventSnapshotCreated, "vol@manual", "", 301},
+		{models.EventChannelProgramRun, "pool1", "", 0},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := program{event.Type, event.Target, event.Source, event.TXG}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if !(*events)[0].Internal {
+		t.Error("record written before the program was not reported as internal")
+	}
+}
+
+func TestLongFormat(t *testing.T) {
+	w, runner := newTestWatcher(Config{LongFormat: true, InternalEvents: true})
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:00 zfs snapshot pool1/vol@a [user 0 (root) on node1:global]",
+		"2024-01-01.10:00:01 zfs destroy pool1/vol@a [user 1001 on node2]",
+		"2024-01-01.10:00:02 [txg:100] destroy pool1/vol@b (770)  [on node1]",
+		"2024-01-01.10:00:03 zfs set com.example:note=[x] pool1/vol",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	type attributed struct {
+		command  string
+		user     string
+		uid      int
+		hostname string
+		zone     string
+		format   string
+	}
+	want := []attributed{
+		{"zfs snapshot pool1/vol@a", "root", 0, "node1", "global", " by root (uid 0) on node1:global"},
+		{"zfs destroy pool1/vol@a", "", 1001, "node2", "", " by uid 1001 on node2"},
+		{"[txg:100] destroy pool1/vol@b (770) ", "", -1, "node1", "", " on node1"},
+		{"zfs set com.example:note=[x] pool1/vol", "", -1, "", "", ""},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("poll reported %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := attributed{event.Command, event.User, event.UID, event.Hostname, event.Zone, formatAttribution(event)}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+		if !strings.HasSuffix(FormatEvent(event), want[i].format) {
+			t.Errorf("FormatEvent(%d) = %q, want suffix %q", i, FormatEvent(event), want[i].format)
+		}
+	}
+
+	if calls := runner.Calls(); calls[0] != "zpool history -i -l pool1" {
+		t.Errorf("history read with %q, want -i -l", calls[0])
+	}
+}
+
+func TestParseEventsMultipleTargets(t *testing.T) {
+	w := New(Config{})
+
+	events, err := w.parseEvents(context.Background(), "2024-01-01.10:00:00 zfs snapshot -o com.example:tag=x tank/a@s1 tank/b@s1", "tank", newInventory())
+	if err != nil {
+		t.Fatalf("parseEvents failed: %v", err)
+	}
+	want := []string{"a@s1", "b@s1"}
+	if got := targets(events); !equalStrings(got, want) {
+		t.Fatalf("parseEvents reported %v, want %v", got, want)
+	}
+	for _, event := range events {
+		if event.Type != models.EventSnapshotCreated {
+			t.Errorf("event %s has type %s, want %s", event.Target, event.Type, models.EventSnapshotCreated)
+		}
+	}
+}
+
+func TestCinderNaming(t *testing.T) {
+	w := New(Config{Naming: CinderNaming()})
+
+	tests := []struct {
+		line   string
+		target string
+	}{
+		{"2024-01-01.10:00:00 zfs create -s -V 1024KB pool1/volume-0a1b_1", "volume-0a1b_1"},
+		{"2024-01-01.10:00:00 zfs snapshot pool1/volume-0a1b_1@snapshot-9f8e", "volume-0a1b_1@snapshot-9f8e"},
+		{"2024-01-01.10:00:00 zfs create pool1/images", ""},
+		{"2024-01-01.10:00:00 zfs create pool1/nested/volume-0a1b_1", ""},
+		{"2024-01-01.10:00:00 zfs snapshot pool1/volume-0a1b_1@daily", ""},
+	}
+	for _, tt := range tests {
+		events, err := w.parseEvents(context.Background(), tt.line, "pool1", newInventory())
+		if tt.target == "" {
+			if err == nil {
+				t.Errorf("parseEvents(%q) reported %v, want it ignored", tt.line, targets(events))
+			}
+			continue
+		}
+		if err != nil || !equalStrings(targets(events), []string{tt.target}) {
+			t.Errorf("parseEvents(%q) = %v, %v, want %q", tt.line, targets(events), err, tt.target)
+		}
+	}
+}
+
+func TestPollReportsOnlyNewEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create -s -V 1024KB pool1/volume-aa_1",
+	)
+	events := collect(w)
+
+	// Existing history is not reported
+	w.processPoolHistory(context.Background(), "pool1", true)
+	if len(*events) != 0 {
+		t.Fatalf("initialization reported %d events, want 0", len(*events))
+	}
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:02 zfs snapshot pool1/volume-aa_1@snapshot-01",
+		"2024-01-01.10:00:03 zfs destroy pool1/volume-aa_1@snapshot-01",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"volume-aa_1@snapshot-01", "volume-aa_1@snapshot-01"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+
+	// Nothing new, nothing reported
+	w.processPoolHistory(context.Background(), "pool1", false)
+	if len(*events) != 2 {
+		t.Fatalf("idle poll reported %d new events, want 0", len(*events)-2)
+	}
+}
+
+func TestPollAfterHistoryRotation(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:02 zfs create pool1/volume-bb_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// The oldest records fall out of the ring and new ones are appended
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:02 zfs create pool1/volume-bb_1",
+		"2024-01-01.10:00:03 zfs create pool1/volume-cc_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"volume-cc_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+
+	// The last consumed record is gone as well: warn about the gap and
+	// rescan without repeats
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:04 zfs create pool1/volume-dd_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want = []string{"volume-cc_1", "pool1", "volume-dd_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+}
+
+func TestPollHistoryGap(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:02 zfs create pool1/volume-bb_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// Records before the last consumed one are dropped: nothing is missed
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:02 zfs create pool1/volume-bb_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+	if len(*events) != 0 {
+		t.Fatalf("poll reported %v, want nothing", targets(*events))
+	}
+
+	// The ring wrapped past the last consumed record, and volume-cc_1 and
+	// volume-dd_1 were dropped unread
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.11:00:00 zfs create pool1/volume-ee_1",
+		"2024-01-01.11:00:01 zfs create pool1/volume-ff_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"pool1", "volume-ee_1", "volume-ff_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+	gap := (*events)[0]
+	from := time.Date(2024, 1, 1, 10, 0, 2, 0, time.Local)
+	to := time.Date(2024, 1, 1, 11, 0, 0, 0, time.Local)
+	if gap.Type != models.EventHistoryGap || gap.Gap == nil || !gap.Gap.From.Equal(from) || !gap.Gap.To.Equal(to) {
+		t.Fatalf("gap event = %s %+v, want %s from %v to %v", gap.Type, gap.Gap, models.EventHistoryGap, from, to)
+	}
+	if got := FormatEvent(gap); !strings.Contains(got, "records from 2024-01-01 10:00:02 to 2024-01-01 11:00:00") {
+		t.Errorf("FormatEvent = %q", got)
+	}
+}
+
+func TestPollHistoryGapInternal(t *testing.T) {
+	w, runner := newTestWatcher(Config{InternalEvents: true},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create -V 1G pool1/vol",
+		"2024-01-01.10:00:02 ioctl snapshot",
+		"    input:",
+		"        snaps:",
+		"            pool1/vol@a",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// The ring wrapped past the last record read; the nvlist below it is
+	// printed again for a later ioctl
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.11:00:00 zfs create -V 1G pool1/vol2",
+		"2024-01-01.11:00:01 ioctl snapshot",
+		"    input:",
+		"        snaps:",
+		"            pool1/vol@a",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"pool1", "vol2"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+	from := time.Date(2024, 1, 1, 10, 0, 2, 0, time.Local)
+	if gap := (*events)[0].Gap; gap == nil || !gap.From.Equal(from) {
+		t.Errorf("gap = %+v, want one from %v", gap, from)
+	}
+}
+
+func TestPollHistoryGapThreshold(t *testing.T) {
+	w, runner := newTestWatcher(Config{GapThreshold: time.Hour},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create pool1/volume-aa_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// Within the threshold of the last record read
+	runner.AppendHistory("pool1", "2024-01-01.11:00:01 zfs create pool1/volume-bb_1")
+	w.processPoolHistory(context.Background(), "pool1", false)
+	if got := targets(*events); !equalStrings(got, []string{"volume-bb_1"}) {
+		t.Fatalf("poll reported %v, want volume-bb_1", got)
+	}
+
+	// The first new record is unexpectedly far ahead
+	*events = nil
+	runner.AppendHistory("pool1",
+		"2024-01-01.12:00:02 zfs create pool1/volume-cc_1",
+		"2024-01-01.15:00:00 zfs create pool1/volume-dd_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"pool1", "volume-cc_1", "volume-dd_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+	gap := (*events)[0]
+	from := time.Date(2024, 1, 1, 11, 0, 1, 0, time.Local)
+	to := time.Date(2024, 1, 1, 12, 0, 2, 0, time.Local)
+	if gap.Type != models.EventHistoryGap || gap.Gap == nil || !gap.Gap.From.Equal(from) || !gap.Gap.To.Equal(to) {
+		t.Fatalf("gap event = %s %+v, want %s from %v to %v", gap.Type, gap.Gap, models.EventHistoryGap, from, to)
+	}
+}
+
+func TestHistoryGapUntilNow(t *testing.T) {
+	// History records carry the local time, which the end of an open gap
+	// must match however far the host is from UTC
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zpool create pool1 sda",
+		"2024-01-01.10:00:01 zfs create pool1/volume-aa_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// Only the record of the pool's creation is left
+	runner.SetHistory("pool1", "2024-01-01.10:00:00 zpool create pool1 sda")
+	before := time.Now()
+	w.processPoolHistory(context.Background(), "pool1", false)
+	after := time.Now()
+
+	if len(*events) != 1 || (*events)[0].Gap == nil {
+		t.Fatalf("poll reported %v, want a gap", targets(*events))
+	}
+	gap := (*events)[0].Gap
+	if from := time.Date(2024, 1, 1, 5, 0, 1, 0, time.UTC); !gap.From.Equal(from) {
+		t.Errorf("gap starts at %v, want %v", gap.From, from)
+	}
+	if gap.To.Before(before) || gap.To.After(after) {
+		t.Errorf("gap ends at %v, want now, between %v and %v", gap.To, before, after)
+	}
+}
+
+func TestHistoryClock(t *testing.T) {
+	// zpool history prints local time, zpool events and zfs list print
+	// seconds since the epoch: all must agree on the same instant
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	w := New(Config{})
+	events, err := w.parseEvents(context.Background(), "2024-01-01.15:00:00 zfs create pool1/vol", "pool1", newInventory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1704103200, 0); !events[0].Timestamp.Equal(want) {
+		t.Errorf("record at %v, want %v", events[0].Timestamp, want.UTC())
+	}
+}
+
+func TestPollDedupsRepeatedCommands(t *testing.T) {
+	w, runner := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	// The same command at the same time is not an event, a later one is
+	runner.SetHistory("pool1",
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:05 zfs create pool1/volume-aa_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	if len(*events) != 1 || !(*events)[0].Timestamp.Equal(time.Date(2024, 1, 1, 10, 0, 5, 0, time.Local)) {
+		t.Fatalf("poll reported %+v, want only the 10:00:05 create", *events)
+	}
+}
+
+func TestPollSinceEvent(t *testing.T) {
+	w, runner := newTestWatcher(Config{SinceEvent: "zfs snapshot pool1/volume-aa_1@snapshot-01"},
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:01 zfs snapshot pool1/volume-aa_1@snapshot-01",
+		"2024-01-01.10:00:02 zfs snapshot pool1/volume-aa_1@snapshot-02",
+	)
+	events := collect(w)
+
+	// Events after the marker are recorded but not reported at startup
+	w.processPoolHistory(context.Background(), "pool1", true)
+	if !w.seenSinceEvent {
+		t.Fatal("marker event was not seen")
+	}
+
+	runner.AppendHistory("pool1", "2024-01-01.10:00:03 zfs destroy pool1/volume-aa_1@snapshot-02")
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"volume-aa_1@snapshot-02"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+}
+
+func TestPollSinceEventNotYetSeen(t *testing.T) {
+	w, runner := newTestWatcher(Config{SinceEvent: "zfs snapshot pool1/volume-aa_1@marker"},
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+	)
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:01 zfs create pool1/volume-bb_1",
+		"2024-01-01.10:00:02 zfs snapshot pool1/volume-aa_1@marker",
+		"2024-01-01.10:00:03 zfs create pool1/volume-cc_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"volume-cc_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+}
+
+func TestPollSinceTime(t *testing.T) {
+	since := time.Date(2024, 1, 1, 10, 0, 1, 0, time.Local)
+	w, runner := newTestWatcher(Config{SinceTime: &since})
+	events := collect(w)
+	w.processPoolHistory(context.Background(), "pool1", true)
+
+	runner.AppendHistory("pool1",
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:01 zfs create pool1/volume-bb_1",
+		"2024-01-01.10:00:02 zfs create pool1/volume-cc_1",
+	)
+	w.processPoolHistory(context.Background(), "pool1", false)
+
+	want := []string{"volume-cc_1"}
+	if got := targets(*events); !equalStrings(got, want) {
+		t.Fatalf("poll reported %v, want %v", got, want)
+	}
+}
+
+func TestGetEventsSinceEvent(t *testing.T) {
+	w, _ := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create -s -V 5244048KB pool1/volume-aa_1",
+		"2024-01-01.10:00:01 zfs snapshot pool1/volume-aa_1@snapshot-01",
+		"2024-01-01.10:00:02 zfs destroy pool1/volume-aa_1",
+	)
+
+	events, err := w.GetEventsSinceEvent("zfs create -s -V 5244048KB")
+	if err != nil {
+		t.Fatalf("GetEventsSinceEvent failed: %v", err)
+	}
+	want := []string{"volume-aa_1@snapshot-01", "volume-aa_1"}
+	if got := targets(events); !equalStrings(got, want) {
+		t.Fatalf("GetEventsSinceEvent returned %v, want %v", got, want)
+	}
+
+	if _, err := w.GetEventsSinceEvent("zfs rename"); err == nil {
+		t.Fatal("GetEventsSinceEvent succeeded for a missing event, want error")
+	}
+}
+
+func TestGetEventsSince(t *testing.T) {
+	w, _ := newTestWatcher(Config{},
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+		"2024-01-01.10:00:05 zfs create pool1/volume-bb_1",
+	)
+
+	events, err := w.GetEventsSince(time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatalf("GetEventsSince failed: %v", err)
+	}
+	want := []string{"volume-bb_1"}
+	if got := targets(events); !equalStrings(got, want) {
+		t.Fatalf("GetEventsSince returned %v, want %v", got, want)
+	}
+}
+
+func TestGetEventsSinceHistoryError(t *testing.T) {
+	w, runner := newTestWatcher(Config{})
+	runner.SetError(errors.New("exit status 1"), "zpool", "history", "pool1")
+
+	if _, err := w.GetEventsSince(time.Time{}); err == nil {
+		t.Fatal("GetEventsSince succeeded, want the history error")
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	w, _ := newTestWatcher(Config{Interval: time.Millisecond},
+		"2024-01-01.10:00:00 zfs create pool1/volume-aa_1",
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v after cancellation, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+func TestRunMissingZpool(t *testing.T) {
+	w := New(Config{
+		Pools:    []string{"pool1"},
+		Interval: time.Second,
+		ZpoolCmd: ZpoolCommand("/nonexistent/zpool"),
+	})
+
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded without a zpool binary, want error")
+	}
+}
+
+// zpoolEvents is zpool events -f -H -v output with a checksum error in an
+// embedded nvlist, a vdev state change, an event of another pool and a
+// finished scrub
+const zpoolEvents = `Jan  1 2024 10:00:00.000000000	ereport.fs.zfs.checksum
+        class = "ereport.fs.zfs.checksum"
+        ena = 0x2b3c4d5e6f700001
+        detector = (embedded nvlist)
+                version = 0x0
+                scheme = "zfs"
+                pool = 0x1234
+        (end detector)
+        pool = "pool1"
+        pool_guid = 0x1234
+        vdev_guid = 0xabcd
+        vdev_type = "disk"
+        vdev_path = "/dev/sdb1"
+        vdev_read_errors = 0x0
+        vdev_write_errors = 0x0
+        vdev_cksum_errors = 0x3
+        time = 0x65928e90 0x0
+        eid = 0x10
+
+Jan  1 2024 10:00:01.000000000	resource.fs.zfs.statechange
+        class = "resource.fs.zfs.statechange"
+        pool = "pool1"
+        pool_guid = 0x1234
+        vdev_guid = 0xabcd
+        vdev_path = "/dev/sdb1"
+        vdev_state = "FAULTED" (0x5)
+        vdev_laststate = "ONLINE" (0x7)
+        time = 0x65928e91 0x0
+        eid = 0x11
+
+Jan  1 2024 10:00:02.000000000	sysevent.fs.zfs.scrub_finish
+        class = "sysevent.fs.zfs.scrub_finish"
+        pool = "pool2"
+        pool_guid = 0x5678
+        time = 0x65928e92 0x0
+        eid = 0x12
+
+Jan  1 2024 10:00:03.000000000	sysevent.fs.zfs.scrub_finish
+        class = "sysevent.fs.zfs.scrub_finish"
+        pool = "pool1"
+        pool_guid = 0x1234
+        time = 0x65928e93 0x0
+        eid = 0x13
+
+`
+
+func TestNativeEvents(t *testing.T) {
+	w, runner := newTestWatcher(Config{Interval: time.Second, NativeEvents: true})
+	runner.SetOutput(zpoolEvents, "zpool", "events", "-f", "-H", "-v")
+	events := collect(w)
+
+	// zpool events replays the queue each time it is restarted
+	since := time.Unix(0x65928e90, 0).Add(-time.Second)
+	for i := 0; i < 2; i++ {
+		if err := w.streamEvents(context.Background(), runner, since); err == nil {
+			t.Fatal("streamEvents returned nil after zpool events exited, want error")
+		}
+	}
+
+	type native struct {
+		typ    models.EventType
+		target string
+		state  string
+		cksum  uint64
+		eid    uint64
+	}
+	want := []native{
+		{models.EventChecksumError, "/dev/sdb1", "", 3, 0x10},
+		{models.EventVdevStateChanged, "/dev/sdb1", "FAULTED", 0, 0x11},
+		{models.EventScrubFinished, "pool1", "", 0, 0x13},
+	}
+	if len(*events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(*events), len(want), targets(*events))
+	}
+	for i, event := range *events {
+		got := native{event.Type, event.Target, event.Native.VdevState, event.Native.ChecksumErrors, event.Native.EID}
+		if got != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got, want[i])
+		}
+		if event.Source != models.SourceZpoolEvents || event.Pool != "pool1" || event.Native.PoolGUID != 0x1234 {
+			t.Errorf("event %d: source %q, pool %q, pool GUID %#x", i, event.Source, event.Pool, event.Native.PoolGUID)
+		}
+	}
+
+	// Members of the embedded detector nvlist are not top-level members
+	if pool := (*events)[0].Native.Payload["pool"]; pool != "pool1" {
+		t.Errorf("payload pool = %q, want pool1", pool)
+	}
+	if _, ok := (*events)[0].Native.Payload["scheme"]; ok {
+		t.Error("payload has embedded member scheme")
+	}
+
+	if got := describeEvent((*events)[1]); !strings.Contains(got, "/dev/sdb1 from ONLINE to FAULTED") {
+		t.Errorf("describeEvent = %q", got)
+	}
+}
+
+func TestVdevState(t *testing.T) {
+	tests := map[string]string{
+		`"FAULTED" (0x5)`: "FAULTED",
+		`"" (0x6)`:        "DEGRADED",
+		"0x7":             "ONLINE",
+		"6":               "DEGRADED",
+		"0x20":            "0x20",
+		"":                "",
+	}
+	for value, want := range tests {
+		if got := vdevState(value); got != want {
+			t.Errorf("vdevState(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRunNativeEventsNeedsStreamRunner(t *testing.T) {
+	w := New(Config{
+		Pools:        []string{"pool1"},
+		Interval:     time.Second,
+		Runner:       outputRunner{},
+		NativeEvents: true,
+	})
+
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded with a runner that cannot stream, want error")
+	}
+}
+
+// outputRunner is a CommandRunner that is not a StreamRunner
+type outputRunner struct{}
+
+func (outputRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestZedEvent(t *testing.T) {
+	event, err := ZedEvent([]string{
+		"PATH=/usr/bin:/bin",
+		"ZED_PID=1234",
+		"ZEVENT_CLASS=resource.fs.zfs.statechange",
+		"ZEVENT_SUBCLASS=statechange",
+		"ZEVENT_EID=42",
+		"ZEVENT_POOL=pool1",
+		"ZEVENT_POOL_GUID=0x1234",
+		"ZEVENT_VDEV_PATH=/dev/sdb1",
+		"ZEVENT_VDEV_STATE=6",
+		"ZEVENT_VDEV_LASTSTATE=7",
+		"ZEVENT_TIME_SECS=1704103569",
+		"ZEVENT_TIME_NSECS=500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Type != models.EventVdevStateChanged || event.Source != models.SourceZed || event.Pool != "pool1" || event.Target != "/dev/sdb1" {
+		t.Errorf("event = %s %q %s %s", event.Type, event.Source, event.Pool, event.Target)
+	}
+	if got := *event.Native; got.EID != 42 || got.PoolGUID != 0x1234 || got.VdevState != "DEGRADED" || got.VdevLastState != "ONLINE" {
+		t.Errorf("native = %+v", got)
+	}
+	if want := time.Unix(1704103569, 500); !event.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", event.Timestamp, want)
+	}
+
+	if _, err := ZedEvent([]string{"PATH=/usr/bin"}); err == nil {
+		t.Error("ZedEvent succeeded without ZEVENT_CLASS, want error")
+	}
+}
+
+func TestDispatchNativeOutOfOrder(t *testing.T) {
+	w, _ := newTestWatcher(Config{})
+	events := collect(w)
+
+	// ZED runs zedlets concurrently, and zpool events delivers them again
+	at := time.Unix(1704103569, 0)
+	for _, eid := range []uint64{5, 4, 5, 6, 4} {
+		w.dispatchNative(zevent("ereport.fs.zfs.io", map[string]string{
+			"pool": "pool1",
+			"eid":  strconv.FormatUint(eid, 10),
+		}, at.Add(time.Duration(eid)*time.Second)))
+	}
+
+	var eids []uint64
+	for _, event := range *events {
+		eids = append(eids, event.Native.EID)
+	}
+	if !reflect.DeepEqual(eids, []uint64{5, 4, 6}) {
+		t.Errorf("reported event ids %v, want [5 4 6]", eids)
+	}
+}
+
+func TestRunEventSocket(t *testing.T) {
+	socket := t.TempDir() + "/watcher.sock"
+	w, _ := newTestWatcher(Config{Interval: time.Hour, EventSocket: socket})
+	received := make(chan models.ZFSEvent, 10)
+	w.AddEventHandler(func(event models.ZFSEvent) {
+		received <- event
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	// Events of other pools and events reported before are dropped
+	other := models.ZFSEvent{Pool: "pool2", Native: &models.NativeEvent{Class: "sysevent.fs.zfs.scrub_finish", EID: 1}}
+	event := models.ZFSEvent{Pool: "pool1", Type: models.EventScrubFinished, Native: &models.NativeEvent{Class: "sysevent.fs.zfs.scrub_finish", EID: 2}}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, e := range []models.ZFSEvent{other, event, event} {
+		var err error
+		for err = SendEvent(ctx, socket, e); err != nil && time.Now().Before(deadline); err = SendEvent(ctx, socket, e) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case got := <-received:
+		if got.Pool != "pool1" || got.Type != models.EventScrubFinished || got.Native.EID != 2 {
+			t.Errorf("received %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancellation, want nil", err)
+	}
+	if len(received) != 0 {
+		t.Errorf("received %d more events, want none", len(received))
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	socket := t.TempDir() + "/watcher.sock"
+	listener, err := listenEvents(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// A running watcher's socket is not taken over
+	if second, err := listenEvents(socket); err == nil {
+		second.Close()
+		t.Fatal("listened on the socket of a running watcher")
+	}
+	listener.Close()
+	if _, err := os.Lstat(socket); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket left behind after Close: %v", err)
+	}
+
+	// A socket left behind by a watcher that died is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = listenEvents(socket)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	listener.Close()
+}
+
+// setListing registers the zfs list output reconciliation reads, one
+// "name type volsize creation guid" row per line with used left out
+func setListing(runner *FakeRunner, rows ...string) {
+	var b strings.Builder
+	for _, row := range rows {
+		f := strings.Fields(row)
+		b.WriteString(strings.Join([]string{f[0], f[1], f[2], "4096", f[3], f[4]}, "\t") + "\n")
+	}
+	runner.SetOutput(b.String(), "zfs", reconcileArgs...)
+}
+
+func TestReconcile(t *testing.T) {
+	w, runner := newTestWatcher(Config{Interval: time.Second, ReconcileInterval: time.Minute},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol1",
+		"2024-01-01.10:00:01 zfs create pool1/fs",
+		"2024-01-01.10:00:02 zfs create pool1/fs/child",
+		"2024-01-01.10:00:03 zfs receive pool1/recv",
+	)
+	events := collect(w)
+	ctx := context.Background()
+	if err := w.processPoolHistory(ctx, "pool1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	setListing(runner,
+		"pool1 filesystem - 1704103200 1",
+		"pool1/vol1 volume 1073741824 1704103200 2",
+		"pool1/old volume 1073741824 1704000000 3",
+		"pool1/fs filesystem - 1704103201 4",
+		"pool1/fs/child filesystem - 1704103202 5",
+		"pool1/replaced filesystem - 1704000000 6",
+		"pool1/old@b snapshot - 1704000002 14",
+		"pool1/old@a snapshot - 1704000001 15",
+		"pool1/recv filesystem - 1704103203 12",
+		"pool2/other filesystem - 1704000000 7",
+	)
+	if err := w.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first listing is only recorded, adding the datasets whose
+	// records left the ring to the inventory
+	if len(*events) != 0 {
+		t.Fatalf("first reconciliation reported %v, want nothing", targets(*events))
+	}
+	if kind, _ := w.inventory.kind("pool1/old"); kind != datasetVolume {
+		t.Errorf("old is a %q in the inventory, want a volume", kind)
+	}
+	if snapshots := w.inventory.snapshots["pool1/old"]; !equalStrings(snapshots, []string{"a", "b"}) {
+		t.Errorf("old has snapshots %v in the inventory, want [a b]", snapshots)
+	}
+	if kind, _ := w.inventory.kind("pool1/recv"); kind != datasetFilesystem {
+		t.Errorf("recv is a %q in the inventory, want a filesystem", kind)
+	}
+
+	// History explains vol2 and the recursive destroy of fs; the resize of
+	// vol1, the new snapshot, the replaced filesystem and the deletion of
+	// old happened behind its back
+	runner.AppendHistory("pool1",
+		"2024-01-01.11:00:00 zfs create -V 2G pool1/vol2",
+		"2024-01-01.11:00:01 zfs destroy -r pool1/fs",
+	)
+	setListing(runner,
+		"pool1 filesystem - 1704103200 1",
+		"pool1/vol1 volume 2147483648 1704103200 2",
+		"pool1/vol1@auto snapshot - 1704106800 8",
+		"pool1/vol2 volume 2147483648 1704106800 9",
+		"pool1/replaced filesystem - 1704106801 10",
+		"pool1/recv filesystem - 1704103203 12",
+		"pool2/new filesystem - 1704106800 11",
+	)
+	if err := w.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	type reconciled struct {
+		typ    models.EventType
+		target string
+		source models.EventSource
+		size   uint64
+	}
+	want := []reconciled{
+		{models.EventVolumeCreated, "vol2", "", 2147483648},
+		{models.EventVolumeDeleted, "old", models.SourceReconcile, 0},
+		{models.EventSnapshotDeleted, "old@a", models.SourceReconcile, 0},
+		{models.EventSnapshotDeleted, "old@b", models.SourceReconcile, 0},
+		{models.EventFilesystemDeleted, "replaced", models.SourceReconcile, 0},
+		{models.EventFilesystemCreated, "replaced", models.SourceReconcile, 0},
+		{models.EventVolumeResized, "vol1", models.SourceReconcile, 2147483648},
+		{models.EventSnapshotCreated, "vol1@auto", models.SourceReconcile, 0},
+	}
+	var got []reconciled
+	for _, event := range *events {
+		// Skip the history events of the destroy
+		if event.Type == models.EventFilesystemDeleted && event.Source == "" {
+			continue
+		}
+		got = append(got, reconciled{event.Type, event.Target, event.Source, event.SizeBytes})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+	if last := (*events)[len(*events)-1]; !last.Timestamp.Equal(time.Unix(1704106800, 0)) || !strings.HasSuffix(FormatEvent(last), " (reconciled)") {
+		t.Errorf("snapshot event at %v: %q", last.Timestamp, FormatEvent(last))
+	}
+	if _, ok := w.inventory.kind("pool1/old"); ok || !w.inventory.hasSnapshot("pool1/vol1", "auto") {
+		t.Errorf("reconciled changes not applied to the inventory: %v %v", w.inventory.datasets, w.inventory.snapshots)
+	}
+
+	// Nothing changed since
+	*events = nil
+	if err := w.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Errorf("unchanged reconciliation reported %v, want nothing", targets(*events))
+	}
+}
+
+func TestReconcileCreatedParents(t *testing.T) {
+	w, runner := newTestWatcher(Config{Interval: time.Second, ReconcileInterval: time.Minute},
+		"2024-01-01.10:00:00 zfs create -V 1G pool1/vol1",
+		"2024-01-01.10:00:01 zfs snapshot pool1/vol1@s",
+		"2024-01-01.10:00:02 zfs create pool1/fs",
+	)
+	events := collect(w)
+	ctx := context.Background()
+	if err := w.processPoolHistory(ctx, "pool1", true); err != nil {
+		t.Fatal(err)
+	}
+	setListing(runner,
+		"pool1 filesystem - 1704103200 1",
+		"pool1/vol1 volume 1073741824 1704103200 2",
+		"pool1/vol1@s snapshot - 1704103201 3",
+		"pool1/fs filesystem - 1704103202 4",
+	)
+	if err := w.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parents created by -p are explained by the commands that did
+	runner.AppendHistory("pool1",
+		"2024-01-01.11:00:00 zfs create -p pool1/a/b/c",
+		"2024-01-01.11:00:01 zfs clone -p pool1/vol1@s pool1/x/y",
+		"2024-01-01.11:00:02 zfs rename -p pool1/fs pool1/r/s/fs",
+	)
+	setListing(runner,
+		"pool1 filesystem - 1704103200 1",
+		"pool1/vol1 volume 1073741824 1704103200 2",
+		"pool1/vol1@s snapshot - 1704103201 3",
+		"pool1/a filesystem - 1704106800 5",
+		"pool1/a/b filesystem - 1704106800 6",
+		"pool1/a/b/c filesystem - 1704106800 7",
+		"pool1/x filesystem - 1704106801 8",
+		"pool1/x/y volume 1073741824 1704106801 9",
+		"pool1/r filesystem - 1704106802 10",
+		"pool1/r/s filesystem - 1704106802 11",
+		"pool1/r/s/fs filesystem - 1704103202 4",
+	)
+	if err := w.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range *events {
+		if event.Source == models.SourceReconcile {
+			t.Errorf("reconciliation reported %s %s", event.Type, event.Target)
+		}
+	}
+	for _, parent := range []string{"pool1/a", "pool1/a/b", "pool1/x", "pool1/r", "pool1/r/s"} {
+		if kind, _ := w.inventory.kind(parent); kind != datasetFilesystem {
+			t.Errorf("%s is a %q in the inventory, want a filesystem", parent, kind)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+)
+
+// zedPrefix is the prefix of the environment variables in which ZED passes
+// the members of an event to zedlets
+const zedPrefix = "ZEVENT_"
+
+// ZedEvent converts the environment ZED runs a zedlet with, as returned by
+// os.Environ, into an event. ZED passes each member of the event as
+// ZEVENT_<NAME>, so the event is the one zpool events would have read, with
+// Source set to models.SourceZed.
+func ZedEvent(environ []string) (models.ZFSEvent, error) {
+	payload := make(map[string]string)
+	for _, variable := range environ {
+		name, value, ok := strings.Cut(variable, "=")
+		if !ok || !strings.HasPrefix(name, zedPrefix) {
+			continue
+		}
+		payload[strings.ToLower(strings.TrimPrefix(name, zedPrefix))] = value
+	}
+
+	class := payload["class"]
+	if class == "" {
+		return models.ZFSEvent{}, errors.New("no ZEVENT_CLASS in the environment, not run by ZED")
+	}
+
+	event := zevent(class, payload, zedTime(payload))
+	event.Source = models.SourceZed
+	return event, nil
+}
+
+// zedTime returns the time of a ZED event from its time member, or from
+// time_secs and time_nsecs, which ZED adds. Events without one happen now.
+func zedTime(payload map[string]string) time.Time {
+	if timestamp := zeventTime("", payload["time"]); !timestamp.IsZero() {
+		return timestamp
+	}
+	if secs := payload["time_secs"]; secs != "" {
+		return time.Unix(int64(zeventNumber(secs)), int64(zeventNumber(payload["time_nsecs"])))
+	}
+	return time.Now()
+}
+
+// SendEvent forwards an event to the watcher accepting events on the Unix
+// socket at path, see Config.EventSocket
+func SendEvent(ctx context.Context, path string, event models.ZFSEvent) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return fmt.Errorf("error connecting to watcher: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(event); err != nil {
+		return fmt.Errorf("error sending event to watcher: %w", err)
+	}
+	return nil
+}
+
+// listenEvents listens on the Unix socket at path, replacing a socket left
+// behind by a previous watcher but not one a running watcher listens on.
+// Only the owner may connect: the socket is created in a directory only the
+// owner may enter and moved into place once its mode is set.
+func listenEvents(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("error listening for events: a watcher is already listening on %s", path)
+		}
+		os.Remove(path)
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".zfs-watcher-")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for events: %w", err)
+	}
+	defer os.Remove(dir)
+
+	private := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for events: %w", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		os.Remove(private)
+		return nil, fmt.Errorf("error listening for events: %w", err)
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		os.Remove(private)
+		return nil, fmt.Errorf("error listening for events: %w", err)
+	}
+	return &socketListener{Listener: listener, path: path}, nil
+}
+
+// socketListener is a listener on a Unix socket that removes the socket when
+// it is closed
+type socketListener struct {
+	net.Listener
+	path   string
+	remove sync.Once
+}
+
+// Close stops listening and removes the socket
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	l.remove.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// serveEvents dispatches the events forwarded to listener until ctx is
+// cancelled, returning once every connection is closed
+func (w *Watcher) serveEvents(ctx context.Context, listener net.Listener) {
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error accepting events: %v", err)
+			}
+			return
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			w.readForwarded(ctx, conn)
+		}()
+	}
+}
+
+// readForwarded dispatches the events sent on a connection until it is
+// closed or ctx is cancelled
+func (w *Watcher) readForwarded(ctx context.Context, conn net.Conn) {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var event models.ZFSEvent
+		if err := decoder.Decode(&event); err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("Error receiving event: %v", err)
+			}
+			return
+		}
+
+		if event.Native != nil {
+			w.dispatchNative(event)
+		} else if w.monitors(event.Pool) {
+			w.dispatch(event)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package watcher
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QumulusTechnology/zfs-tools/pkg/models"
+)
+
+// zeventTypes maps the event classes reported with a type of their own
+var zeventTypes = map[string]models.EventType{
+	"ereport.fs.zfs.checksum":         models.EventChecksumError,
+	"ereport.fs.zfs.io":               models.EventIOError,
+	"ereport.fs.zfs.data":             models.EventDataError,
+	"ereport.fs.zfs.delay":            models.EventIODelay,
+	"ereport.fs.zfs.deadman":          models.EventDeadman,
+	"resource.fs.zfs.statechange":     models.EventVdevStateChanged,
+	"sysevent.fs.zfs.resilver_start":  models.EventResilverStarted,
+	"sysevent.fs.zfs.resilver_finish": models.EventResilverFinished,
+	"sysevent.fs.zfs.scrub_finish":    models.EventScrubFinished,
+}
+
+// historyEventClass is the class of the events written for pool history
+// records
+const historyEventClass = "sysevent.fs.zfs.history_event"
+
+// vdevStates are the names zpool status uses for the values of vdev_state_t
+var vdevStates = []string{"UNKNOWN", "CLOSED", "OFFLINE", "REMOVED", "UNAVAIL", "FAULTED", "DEGRADED", "ONLINE"}
+
+// zeventWindow is the number of events of the kernel module's event queue
+// remembered to drop the ones delivered again
+const zeventWindow = 4096
+
+// zeventKey identifies an event of the kernel module's event queue. Event ids
+// start over when the module is reloaded, so the time is part of it.
+type zeventKey struct {
+	eid  uint64
+	time int64
+}
+
+// zeventTimeLayout is the time format of the first line of a zpool events
+// record, in local time
+const zeventTimeLayout = "Jan _2 2006 15:04:05.000000000"
+
+// followEvents reports the events of zpool events -f until ctx is
+// cancelled, restarting zpool events whenever it exits. Events queued before
+// the watcher started are skipped, unless they are after SinceTime. Only
+// errors that will not go away by themselves are returned.
+func (w *Watcher) followEvents(ctx context.Context, runner StreamRunner) error {
+	since := time.Now()
+	if w.config.SinceTime != nil {
+		since = *w.config.SinceTime
+	}
+
+	for {
+		err := w.streamEvents(ctx, runner, since)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if isFatal(err) {
+			return err
+		}
+		log.Printf("Error: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.config.Interval):
+		}
+	}
+}
+
+// streamEvents runs zpool events -f once and reports its events after
+// since, returning why it stopped
+func (w *Watcher) streamEvents(ctx context.Context, runner StreamRunner, since time.Time) error {
+	stream, err := runner.Stream(ctx, string(w.config.ZpoolCmd), "events", "-f", "-H", "-v")
+	if err != nil {
+		return fmt.Errorf("error following zpool events: %w", err)
+	}
+
+	// Records are a header line followed by indented members and end with
+	// an empty line
+	var record []string
+	flush := func() {
+		if len(record) > 0 {
+			w.processZevent(record, since)
+			record = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() && ctx.Err() == nil {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case line[0] != ' ' && line[0] != '\t':
+			flush()
+			record = append(record, line)
+		case len(record) > 0:
+			record = append(record, line)
+		}
+	}
+	flush()
+	scanErr := scanner.Err()
+
+	err = stream.Close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if scanErr != nil {
+		return fmt.Errorf("error reading zpool events: %w", scanErr)
+	}
+	if err != nil {
+		return fmt.Errorf("zpool events exited: %w", err)
+	}
+	return errors.New("zpool events exited")
+}
+
+// processZevent reports the event of a zpool events record if it is about a
+// monitored pool and after since
+func (w *Watcher) processZevent(record []string, since time.Time) {
+	event, ok := parseZevent(record)
+	if !ok || !event.Timestamp.After(since) {
+		return
+	}
+	w.dispatchNative(event)
+}
+
+// dispatchNative notifies the event handlers of an event of the kernel
+// module's event queue, unless it is about a pool that is not monitored or
+// was reported before
+func (w *Watcher) dispatchNative(event models.ZFSEvent) {
+	// History events repeat the records read from pool history
+	if !w.monitors(event.Pool) || event.Native.Class == historyEventClass {
+		return
+	}
+
+	w.dispatchMu.Lock()
+	defer w.dispatchMu.Unlock()
+
+	// zpool events replays the whole queue when it is restarted, and ZED
+	// may deliver the events zpool events reads. ZED runs zedlets
+	// concurrently, so events may arrive out of order.
+	key := zeventKey{event.Native.EID, event.Timestamp.UnixNano()}
+	if w.seenZevents[key] {
+		return
+	}
+	w.seenZevents[key] = true
+	w.zeventOrder = append(w.zeventOrder, key)
+	if len(w.zeventOrder) > zeventWindow {
+		delete(w.seenZevents, w.zeventOrder[0])
+		w.zeventOrder = w.zeventOrder[1:]
+	}
+
+	w.notify(event)
+}
+
+// monitors reports whether pool is one of the monitored pools
+func (w *Watcher) monitors(pool string) bool {
+	for _, p := range w.config.Pools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// parseZevent parses a record of zpool events -H -v into an event. Records
+// without a class are not events.
+func parseZevent(record []string) (models.ZFSEvent, bool) {
+	header := strings.Split(record[0], "\t")
+	payload := zeventMembers(record[1:])
+	class := payload["class"]
+	if class == "" {
+		class = strings.TrimSpace(header[len(header)-1])
+	}
+	if class == "" {
+		return models.ZFSEvent{}, false
+	}
+	return zevent(class, payload, zeventTime(header[0], payload["time"])), true
+}
+
+// zevent returns the event of an event class with the given members,
+// named as in zpool events -v
+func zevent(class string, payload map[string]string, timestamp time.Time) models.ZFSEvent {
+	native := &models.NativeEvent{
+		Class:          class,
+		EID:            zeventNumber(payload["eid"]),
+		PoolGUID:       zeventNumber(payload["pool_guid"]),
+		VdevGUID:       zeventNumber(payload["vdev_guid"]),
+		VdevPath:       payload["vdev_path"],
+		VdevType:       payload["vdev_type"],
+		VdevState:      vdevState(payload["vdev_state"]),
+		VdevLastState:  vdevState(payload["vdev_laststate"]),
+		ReadErrors:     zeventNumber(payload["vdev_read_errors"]),
+		WriteErrors:    zeventNumber(payload["vdev_write_errors"]),
+		ChecksumErrors: zeventNumber(payload["vdev_cksum_errors"]),
+		Payload:        payload,
+	}
+
+	event := models.ZFSEvent{
+		Timestamp: timestamp,
+		Command:   class,
+		Source:    models.SourceZpoolEvents,
+		Pool:      payload["pool"],
+		UID:       -1,
+		Type:      models.EventNative,
+		Target:    payload["pool"],
+		Native:    native,
+	}
+	if typ, ok := zeventTypes[class]; ok {
+		event.Type = typ
+	}
+	if native.VdevPath != "" {
+		event.Target = native.VdevPath
+		event.Device = native.VdevPath
+	}
+	return event
+}
+
+// zeventMembers returns the top-level members of an nvlist as printed by
+// zpool events -v, skipping embedded nvlists and arrays of them
+func zeventMembers(lines []string) map[string]string {
+	members := make(map[string]string)
+	depth := 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "(start "):
+			depth++
+			continue
+		case strings.HasPrefix(line, "(end "):
+			depth--
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			continue
+		}
+		if value == "(embedded nvlist)" {
+			depth++
+			continue
+		}
+		if depth > 0 || strings.HasPrefix(value, "(array of embedded nvlists)") {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		members[name] = strings.TrimSpace(value)
+	}
+	return members
+}
+
+// zeventNumber parses a number as printed by zpool events, usually in hex,
+// returning 0 if it is missing or not a number
+func zeventNumber(value string) uint64 {
+	n, _ := strconv.ParseUint(value, 0, 64)
+	return n
+}
+
+// vdevState returns the name of a vdev state as printed by zpool events,
+// e.g. `"FAULTED" (0x5)`, or as a bare number, as ZED passes it. It returns
+// "" if there is none.
+func vdevState(value string) string {
+	if quoted, ok := strings.CutPrefix(value, `"`); ok {
+		if name, _, ok := strings.Cut(quoted, `"`); ok && name != "" {
+			return name
+		}
+	}
+	if _, number, ok := strings.Cut(value, "("); ok {
+		value = strings.TrimSuffix(strings.TrimSpace(number), ")")
+	}
+	if value == "" {
+		return ""
+	}
+	n, err := strconv.ParseUint(value, 0, 64)
+	if err != nil || n >= uint64(len(vdevStates)) {
+		return value
+	}
+	return vdevStates[n]
+}
+
+// zeventTime returns the time of an event from its time member, seconds and
+// nanoseconds, falling back to the time on the header line
+func zeventTime(header string, member string) time.Time {
+	if fields := strings.Fields(member); len(fields) == 2 {
+		sec, err1 := strconv.ParseInt(fields[0], 0, 64)
+		nsec, err2 := strconv.ParseInt(fields[1], 0, 64)
+		if err1 == nil && err2 == nil {
+			return time.Unix(sec, nsec)
+		}
+	}
+	timestamp, _ := time.ParseInLocation(zeventTimeLayout, strings.TrimSpace(header), time.Local)
+	return timestamp
+}
@@ -0,0 +1,76 @@
+package zfscmd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sizeShifts maps the unit letters zfs accepts to their power of two
+var sizeShifts = map[byte]uint{
+	'B': 0,
+	'K': 10,
+	'M': 20,
+	'G': 30,
+	'T': 40,
+	'P': 50,
+	'E': 60,
+}
+
+// ParseSize parses a size the way zfs does for volsize, quota and similar
+// properties, returning the number of bytes. The number may be a decimal
+// fraction and is followed by an optional unit: B, or one of K, M, G, T, P
+// and E, optionally followed by B or iB, in either case. Units are powers of
+// 1024, so "1.5T", "1536G" and "1536GiB" are all the same size.
+func ParseSize(size string) (uint64, error) {
+	number := strings.TrimRight(size, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	unit := strings.ToUpper(size[len(number):])
+	number = strings.TrimRight(number, " ")
+	if number == "" || strings.Trim(number, "0123456789.") != "" {
+		return 0, fmt.Errorf("bad numeric value %q", size)
+	}
+
+	shift, err := unitShift(unit)
+	if err != nil {
+		return 0, fmt.Errorf("%v in %q", err, size)
+	}
+
+	if !strings.Contains(number, ".") {
+		n, err := strconv.ParseUint(number, 10, 64)
+		if err != nil || n > math.MaxUint64>>shift {
+			return 0, fmt.Errorf("numeric value %q is too large", size)
+		}
+		return n << shift, nil
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric value %q", size)
+	}
+	f *= float64(uint64(1) << shift)
+	if f >= math.MaxUint64 {
+		return 0, fmt.Errorf("numeric value %q is too large", size)
+	}
+	return uint64(f), nil
+}
+
+// unitShift returns the power of two of an upper case size unit
+func unitShift(unit string) (uint, error) {
+	if unit == "" {
+		return 0, nil
+	}
+	shift, ok := sizeShifts[unit[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid numeric suffix %q", unit)
+	}
+	switch unit[1:] {
+	case "":
+		return shift, nil
+	case "B", "IB":
+		if shift != 0 {
+			return shift, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid numeric suffix %q", unit)
+}
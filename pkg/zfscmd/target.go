@@ -0,0 +1,74 @@
+package zfscmd
+
+import (
+	"strings"
+)
+
+// TargetKind is the kind of object a command operand names
+type TargetKind int
+
+const (
+	// KindDataset is a pool, filesystem or volume, e.g. tank/vol
+	KindDataset TargetKind = iota
+
+	// KindSnapshot is a snapshot, e.g. tank/vol@snap
+	KindSnapshot
+
+	// KindBookmark is a bookmark, e.g. tank/vol#mark
+	KindBookmark
+)
+
+// String returns the name of the kind
+func (k TargetKind) String() string {
+	switch k {
+	case KindSnapshot:
+		return "snapshot"
+	case KindBookmark:
+		return "bookmark"
+	default:
+		return "dataset"
+	}
+}
+
+// Target is a dataset, snapshot or bookmark named by a command operand
+type Target struct {
+	// Name is the operand as written
+	Name string
+
+	// Kind is the kind of object named
+	Kind TargetKind
+
+	// Dataset is the dataset part of the name, before any '@' or '#'
+	Dataset string
+
+	// Snapshot is the part after '@' for snapshots. For zfs destroy this may
+	// be a comma separated list or a '%' range of snapshots.
+	Snapshot string
+
+	// Bookmark is the part after '#' for bookmarks
+	Bookmark string
+}
+
+// ParseTarget parses a dataset, snapshot or bookmark name
+func ParseTarget(name string) Target {
+	target := Target{Name: name, Dataset: name}
+
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		target.Kind = KindSnapshot
+		target.Dataset = name[:i]
+		target.Snapshot = name[i+1:]
+	} else if i := strings.IndexByte(name, '#'); i >= 0 {
+		target.Kind = KindBookmark
+		target.Dataset = name[:i]
+		target.Bookmark = name[i+1:]
+	}
+	return target
+}
+
+// Pool returns the name of the pool the target belongs to
+func (t Target) Pool() string {
+	if i := strings.IndexByte(t.Dataset, '/'); i >= 0 {
+		return t.Dataset[:i]
+	}
+	return t.Dataset
+}
@@ -0,0 +1,81 @@
+package zfscmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tokenize splits a command line into arguments. Arguments are separated by
+// whitespace; single quotes, double quotes and backslash escapes group
+// characters the way a POSIX shell does. Use SplitHistory for command lines
+// read from zpool history, which are not quoted.
+func Tokenize(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	quote := rune(0)
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// SplitHistory splits a command line as recorded in zpool history into
+// arguments. History joins the arguments with single spaces without quoting
+// them, so quotes and backslashes are literal characters and arguments are
+// separated by spaces only.
+func SplitHistory(line string) []string {
+	var args []string
+	for _, arg := range strings.Split(line, " ") {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
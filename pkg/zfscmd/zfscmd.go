@@ -0,0 +1,359 @@
+// Package zfscmd parses zfs and zpool command lines, as recorded in zpool
+// history, into a structured form.
+package zfscmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command is a parsed zfs or zpool command line
+type Command struct {
+	// Program is "zfs" or "zpool"
+	Program string
+
+	// Subcommand is the canonical subcommand name, e.g. "snapshot" for "snap"
+	Subcommand string
+
+	// Flags maps each single-letter flag to its arguments in the order
+	// given. Flags that take no argument map to a single empty string per
+	// occurrence.
+	Flags map[string][]string
+
+	// Properties holds the property assignments of the command, given as
+	// -o key=value options or, for zfs set and zpool set, as key=value
+	// operands
+	Properties map[string]string
+
+	// Args are the positional operands in order
+	Args []string
+
+	// Targets are the operands naming pools, datasets, snapshots or
+	// bookmarks, in order
+	Targets []Target
+}
+
+// HasFlag reports whether the single-letter flag was given. Like Flag and
+// Target it may be called on a nil Command, which has no flags.
+func (c *Command) HasFlag(flag string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.Flags[flag]
+	return ok
+}
+
+// Flag returns the argument of the last occurrence of flag
+func (c *Command) Flag(flag string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	values, ok := c.Flags[flag]
+	if !ok {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// Target returns the first target of the command
+func (c *Command) Target() (Target, bool) {
+	if c == nil || len(c.Targets) == 0 {
+		return Target{}, false
+	}
+	return c.Targets[0], true
+}
+
+// spec describes the command line of a subcommand
+type spec struct {
+	// optstring lists the flags in getopt(3) syntax, a ':' following each
+	// flag that takes an argument
+	optstring string
+
+	// leading is the number of operands preceding the targets, or -1 for
+	// any number of key=value property assignments
+	leading int
+
+	// targets is the number of operands naming targets, or -1 for all
+	// remaining operands
+	targets int
+}
+
+// zfsSpecs describes the zfs subcommands that are recorded in pool history
+var zfsSpecs = map[string]spec{
+	"bookmark":   {optstring: "", targets: 2},
+	"change-key": {optstring: "ilo:", targets: -1},
+	"clone":      {optstring: "o:pu", targets: 2},
+	"create":     {optstring: "b:no:pPsuvV:", targets: -1},
+	"destroy":    {optstring: "dfnpRrv", targets: -1},
+	"hold":       {optstring: "r", leading: 1, targets: -1},
+	"inherit":    {optstring: "rS", leading: 1, targets: -1},
+	"load-key":   {optstring: "aL:nr", targets: -1},
+	"program":    {optstring: "jm:nt:", targets: 1},
+	"promote":    {optstring: "", targets: -1},
+	"receive":    {optstring: "AcdeFhMno:suvx:", targets: -1},
+	"release":    {optstring: "r", leading: 1, targets: -1},
+	"rename":     {optstring: "fnprsu", targets: 2},
+	"rollback":   {optstring: "fRr", targets: -1},
+	"set":        {optstring: "u", leading: -1, targets: -1},
+	"snapshot":   {optstring: "o:r", targets: -1},
+	"unload-key": {optstring: "ar", targets: -1},
+	"upgrade":    {optstring: "arvV:", targets: -1},
+}
+
+// zpoolSpecs describes the zpool subcommands that are recorded in pool
+// history. The first operand names the pool; any further operands are
+// devices or vdev specifications.
+var zpoolSpecs = map[string]spec{
+	"add":        {optstring: "fgLno:P", targets: 1},
+	"attach":     {optstring: "fo:sw", targets: 1},
+	"clear":      {optstring: "FnX", targets: 1},
+	"create":     {optstring: "dfm:no:O:R:t:", targets: 1},
+	"detach":     {optstring: "", targets: 1},
+	"export":     {optstring: "af", targets: 1},
+	"import":     {optstring: "aCc:d:DEfFlmnNo:R:sT:VX", targets: 1},
+	"initialize": {optstring: "cusw", targets: 1},
+	"offline":    {optstring: "ft", targets: 1},
+	"online":     {optstring: "eft", targets: 1},
+	"reguid":     {optstring: "", targets: 1},
+	"remove":     {optstring: "npsw", targets: 1},
+	"replace":    {optstring: "fo:sw", targets: 1},
+	"scrub":      {optstring: "Cepsw", targets: 1},
+	"set":        {optstring: "", leading: 1, targets: 1},
+	"split":      {optstring: "gLno:PR:", targets: 1},
+	"trim":       {optstring: "cdr:sw", targets: 1},
+	"upgrade":    {optstring: "aV:v", targets: 1},
+}
+
+// zfsAliases maps abbreviated zfs subcommands to their canonical names
+var zfsAliases = map[string]string{
+	"recv": "receive",
+	"snap": "snapshot",
+}
+
+// Parse parses a zfs or zpool command line such as
+// "zfs create -s -V 10G -o compression=lz4 tank/vol". Flags are parsed the
+// way getopt(3) does: they may be combined ("-sV 10G"), arguments may be
+// attached ("-V10G"), flags may follow operands and "--" ends the flags.
+// Subcommands unknown to the parser are accepted with every flag treated as
+// taking no argument and every operand as a target.
+func Parse(line string) (*Command, error) {
+	args, err := Tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+	return parse(line, args)
+}
+
+// ParseHistory parses a command line as recorded in the history of pool,
+// see SplitHistory. An argument that contained spaces cannot be told from
+// several arguments, but only property values may contain spaces: the words
+// following a -o property assignment, or a zfs set one, up to the next flag
+// or word naming something in pool are taken to be part of its value.
+func ParseHistory(line string, pool string) (*Command, error) {
+	args := SplitHistory(line)
+	if len(args) >= 2 {
+		args = joinValues(args, pool)
+	}
+	return parse(line, args)
+}
+
+// joinValues rejoins the words of the property values that history split on
+// spaces, see ParseHistory
+func joinValues(args []string, pool string) []string {
+	set := args[0] == "zfs" && args[1] == "set"
+	optstring := lookupSpec(args[0], args[1]).optstring
+
+	joined := args[:2:2]
+	inValue := false
+	for i := 2; i < len(args); i++ {
+		arg := args[i]
+		isFlag := len(arg) > 1 && arg[0] == '-'
+		if inValue && !isFlag && !inPool(arg, pool) && !(set && strings.Contains(arg, "=")) {
+			joined[len(joined)-1] += " " + arg
+			continue
+		}
+		joined = append(joined, arg)
+		inValue = set && !isFlag && strings.Contains(arg, "=")
+
+		if !isFlag || arg == "--" {
+			continue
+		}
+		switch propertyOption(arg[1:], optstring) {
+		case optionAttached:
+			inValue = true
+		case optionNext:
+			if i+1 < len(args) {
+				i++
+				joined = append(joined, args[i])
+				inValue = true
+			}
+		}
+	}
+	return joined
+}
+
+// Where a word of flags puts the value of -o, see propertyOption
+const (
+	optionNone = iota
+	optionAttached
+	optionNext
+)
+
+// propertyOption reports whether a word of flags ends in -o and whether its
+// value is attached to it or the next word
+func propertyOption(flags string, optstring string) int {
+	for j := 0; j < len(flags); j++ {
+		if !takesArgument(optstring, flags[j]) {
+			continue
+		}
+		switch {
+		case flags[j] != 'o':
+			return optionNone
+		case j+1 < len(flags):
+			return optionAttached
+		default:
+			return optionNext
+		}
+	}
+	return optionNone
+}
+
+// inPool reports whether name names pool or something in it
+func inPool(name string, pool string) bool {
+	if pool == "" || !strings.HasPrefix(name, pool) {
+		return false
+	}
+	rest := name[len(pool):]
+	return rest == "" || strings.ContainsAny(rest[:1], "/@#")
+}
+
+// parse parses the arguments of a command line
+func parse(line string, args []string) (*Command, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("missing subcommand in %q", line)
+	}
+
+	cmd := &Command{
+		Program:    args[0],
+		Subcommand: args[1],
+		Flags:      make(map[string][]string),
+		Properties: make(map[string]string),
+	}
+
+	switch cmd.Program {
+	case "zfs":
+		if canonical, ok := zfsAliases[cmd.Subcommand]; ok {
+			cmd.Subcommand = canonical
+		}
+	case "zpool":
+	default:
+		return nil, fmt.Errorf("not a zfs or zpool command: %q", line)
+	}
+	s := lookupSpec(cmd.Program, cmd.Subcommand)
+
+	if err := cmd.parseArgs(args[2:], s.optstring); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", cmd.Program, cmd.Subcommand, err)
+	}
+	cmd.collectTargets(s)
+	return cmd, nil
+}
+
+// lookupSpec returns the spec of a zfs or zpool subcommand, which may be
+// abbreviated. Unknown subcommands take no flag arguments.
+func lookupSpec(program string, subcommand string) spec {
+	specs := zpoolSpecs
+	if program == "zfs" {
+		specs = zfsSpecs
+		if canonical, ok := zfsAliases[subcommand]; ok {
+			subcommand = canonical
+		}
+	}
+	if s, ok := specs[subcommand]; ok {
+		return s
+	}
+	return spec{targets: -1}
+}
+
+// parseArgs splits args into flags and operands according to optstring
+func (c *Command) parseArgs(args []string, optstring string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			c.Args = append(c.Args, args[i+1:]...)
+			return nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			c.Args = append(c.Args, arg)
+			continue
+		}
+
+		for j := 1; j < len(arg); j++ {
+			flag := string(arg[j])
+			if !takesArgument(optstring, arg[j]) {
+				c.Flags[flag] = append(c.Flags[flag], "")
+				continue
+			}
+
+			// The argument is the rest of this word or the next word
+			value := arg[j+1:]
+			if value == "" {
+				if i+1 >= len(args) {
+					return fmt.Errorf("option -%s requires an argument", flag)
+				}
+				i++
+				value = args[i]
+			}
+			c.Flags[flag] = append(c.Flags[flag], value)
+
+			if flag == "o" {
+				c.setProperty(value)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// collectTargets picks the property assignments and targets out of the
+// operands
+func (c *Command) collectTargets(s spec) {
+	operands := c.Args
+
+	if s.leading < 0 {
+		for len(operands) > 0 && strings.Contains(operands[0], "=") {
+			c.setProperty(operands[0])
+			operands = operands[1:]
+		}
+	} else if s.leading > len(operands) {
+		return
+	} else {
+		if c.Subcommand == "set" {
+			for _, assignment := range operands[:s.leading] {
+				c.setProperty(assignment)
+			}
+		}
+		operands = operands[s.leading:]
+	}
+
+	if s.targets >= 0 && s.targets < len(operands) {
+		operands = operands[:s.targets]
+	}
+	for _, operand := range operands {
+		c.Targets = append(c.Targets, ParseTarget(operand))
+	}
+}
+
+// setProperty records a key=value property assignment
+func (c *Command) setProperty(assignment string) {
+	if key, value, ok := strings.Cut(assignment, "="); ok {
+		c.Properties[key] = value
+	}
+}
+
+// takesArgument reports whether flag takes an argument according to
+// optstring
+func takesArgument(optstring string, flag byte) bool {
+	i := strings.IndexByte(optstring, flag)
+	return i >= 0 && flag != ':' && i+1 < len(optstring) && optstring[i+1] == ':'
+}
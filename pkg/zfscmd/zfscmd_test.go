@@ -0,0 +1,322 @@
+package zfscmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"zfs create tank/vol", []string{"zfs", "create", "tank/vol"}},
+		{"  zfs   create\ttank/vol  ", []string{"zfs", "create", "tank/vol"}},
+		{`zfs set com.example:note="two words" tank/vol`, []string{"zfs", "set", "com.example:note=two words", "tank/vol"}},
+		{`zfs set 'com.example:note=it''s' tank/vol`, []string{"zfs", "set", "com.example:note=its", "tank/vol"}},
+		{`zfs set com.example:note=a\ b tank/vol`, []string{"zfs", "set", "com.example:note=a b", "tank/vol"}},
+		{`zfs set com.example:note="say \"hi\"" tank/vol`, []string{"zfs", "set", `com.example:note=say "hi"`, "tank/vol"}},
+		{`zfs set com.example:note="" tank/vol`, []string{"zfs", "set", "com.example:note=", "tank/vol"}},
+	}
+	for _, tt := range tests {
+		got, err := Tokenize(tt.line)
+		if err != nil {
+			t.Errorf("Tokenize(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{`zfs set a="b tank`, `zfs set a='b tank`, `zfs create tank\`} {
+		if _, err := Tokenize(line); err == nil {
+			t.Errorf("Tokenize(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Command
+	}{
+		{
+			name: "combined flags and attached argument",
+			line: "zfs create -sV10G -o compression=lz4 -o volblocksize=16K tank/vol",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "create",
+				Flags:      map[string][]string{"s": {""}, "V": {"10G"}, "o": {"compression=lz4", "volblocksize=16K"}},
+				Properties: map[string]string{"compression": "lz4", "volblocksize": "16K"},
+				Args:       []string{"tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+		{
+			name: "property value with spaces",
+			line: `zfs create -o "com.example:desc=tenant disk" -V 10G tank/vol`,
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "create",
+				Flags:      map[string][]string{"o": {"com.example:desc=tenant disk"}, "V": {"10G"}},
+				Properties: map[string]string{"com.example:desc": "tenant disk"},
+				Args:       []string{"tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+		{
+			name: "flags after operands",
+			line: "zfs create tank/vol -V 1048576KB -s",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "create",
+				Flags:      map[string][]string{"V": {"1048576KB"}, "s": {""}},
+				Properties: map[string]string{},
+				Args:       []string{"tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+		{
+			name: "alias and multiple snapshot targets",
+			line: "zfs snap -r tank/a@daily tank/b@daily",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "snapshot",
+				Flags:      map[string][]string{"r": {""}},
+				Properties: map[string]string{},
+				Args:       []string{"tank/a@daily", "tank/b@daily"},
+				Targets: []Target{
+					{Name: "tank/a@daily", Kind: KindSnapshot, Dataset: "tank/a", Snapshot: "daily"},
+					{Name: "tank/b@daily", Kind: KindSnapshot, Dataset: "tank/b", Snapshot: "daily"},
+				},
+			},
+		},
+		{
+			name: "set with several properties",
+			line: "zfs set volsize=2T com.example:tenant=acme tank/vol",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "set",
+				Flags:      map[string][]string{},
+				Properties: map[string]string{"volsize": "2T", "com.example:tenant": "acme"},
+				Args:       []string{"volsize=2T", "com.example:tenant=acme", "tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+		{
+			name: "hold tag is not a target",
+			line: "zfs hold -r backup tank/vol@snap",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "hold",
+				Flags:      map[string][]string{"r": {""}},
+				Properties: map[string]string{},
+				Args:       []string{"backup", "tank/vol@snap"},
+				Targets:    []Target{{Name: "tank/vol@snap", Kind: KindSnapshot, Dataset: "tank/vol", Snapshot: "snap"}},
+			},
+		},
+		{
+			name: "bookmark",
+			line: "zfs bookmark tank/vol@snap tank/vol#mark",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "bookmark",
+				Flags:      map[string][]string{},
+				Properties: map[string]string{},
+				Args:       []string{"tank/vol@snap", "tank/vol#mark"},
+				Targets: []Target{
+					{Name: "tank/vol@snap", Kind: KindSnapshot, Dataset: "tank/vol", Snapshot: "snap"},
+					{Name: "tank/vol#mark", Kind: KindBookmark, Dataset: "tank/vol", Bookmark: "mark"},
+				},
+			},
+		},
+		{
+			name: "end of flags",
+			line: "zfs destroy -r -- tank/vol",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "destroy",
+				Flags:      map[string][]string{"r": {""}},
+				Properties: map[string]string{},
+				Args:       []string{"tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+		{
+			name: "zpool command targets the pool",
+			line: "zpool replace -o ashift=12 tank sda sdb",
+			want: Command{
+				Program:    "zpool",
+				Subcommand: "replace",
+				Flags:      map[string][]string{"o": {"ashift=12"}},
+				Properties: map[string]string{"ashift": "12"},
+				Args:       []string{"tank", "sda", "sdb"},
+				Targets:    []Target{{Name: "tank", Kind: KindDataset, Dataset: "tank"}},
+			},
+		},
+		{
+			name: "unknown subcommand",
+			line: "zfs frobnicate -x tank/vol",
+			want: Command{
+				Program:    "zfs",
+				Subcommand: "frobnicate",
+				Flags:      map[string][]string{"x": {""}},
+				Properties: map[string]string{},
+				Args:       []string{"tank/vol"},
+				Targets:    []Target{{Name: "tank/vol", Kind: KindDataset, Dataset: "tank/vol"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse(%q) =\n%+v\nwant\n%+v", tt.line, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"zfs",
+		"ls -l /tank",
+		"zfs create -V",
+		`zfs set a="b tank/vol`,
+	} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestParseHistory(t *testing.T) {
+	tests := []struct {
+		line       string
+		properties map[string]string
+		targets    []string
+	}{
+		{"zfs set com.example:note=it's tank/vol", map[string]string{"com.example:note": "it's"}, []string{"tank/vol"}},
+		{`zfs set com.example:note="quoted" tank/vol`, map[string]string{"com.example:note": `"quoted"`}, []string{"tank/vol"}},
+		{`zfs set com.example:note=C:\x tank/vol`, map[string]string{"com.example:note": `C:\x`}, []string{"tank/vol"}},
+		{"zfs set com.example:note=a b tank/vol", map[string]string{"com.example:note": "a b"}, []string{"tank/vol"}},
+		{"zfs set com.example:note=a  b compression=lz4 tank tank/vol@s1", map[string]string{"com.example:note": "a b", "compression": "lz4"}, []string{"tank", "tank/vol@s1"}},
+		{"zfs create -o com.example:desc=tenant disk -V 10G tank/vol", map[string]string{"com.example:desc": "tenant disk"}, []string{"tank/vol"}},
+		{"zfs create -so com.example:desc=a b=c -ocompression=lz4 tank/vol", map[string]string{"com.example:desc": "a b=c", "compression": "lz4"}, []string{"tank/vol"}},
+		{"zfs create -ocom.example:desc=a b tank/vol", map[string]string{"com.example:desc": "a b"}, []string{"tank/vol"}},
+		{"zfs clone -o com.example:desc=a b tank/vol@s1 tank/clone", map[string]string{"com.example:desc": "a b"}, []string{"tank/vol@s1", "tank/clone"}},
+		{"zfs snapshot -r -o com.example:desc=before upgrade tank/vol@s1", map[string]string{"com.example:desc": "before upgrade"}, []string{"tank/vol@s1"}},
+		{"zfs receive -o com.example:desc=a b -x compression tank/vol", map[string]string{"com.example:desc": "a b"}, []string{"tank/vol"}},
+		{"zfs create -V 10G -b 8K tank/vol", map[string]string{}, []string{"tank/vol"}},
+	}
+	for _, tt := range tests {
+		cmd, err := ParseHistory(tt.line, "tank")
+		if err != nil {
+			t.Errorf("ParseHistory(%q) failed: %v", tt.line, err)
+			continue
+		}
+		var names []string
+		for _, target := range cmd.Targets {
+			names = append(names, target.Name)
+		}
+		if !reflect.DeepEqual(cmd.Properties, tt.properties) || !reflect.DeepEqual(names, tt.targets) {
+			t.Errorf("ParseHistory(%q) = %q on %q, want %q on %q", tt.line, cmd.Properties, names, tt.properties, tt.targets)
+		}
+	}
+
+	if cmd, err := ParseHistory(`zfs create -V 1G tank/it's\`, "tank"); err != nil || cmd.Targets[0].Name != `tank/it's\` {
+		t.Errorf("ParseHistory did not keep quotes and backslashes literal: %+v, %v", cmd, err)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	cmd, err := Parse("zfs receive -o mountpoint=/a -x compression -F -o mountpoint=/b tank/vol")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if !cmd.HasFlag("F") || cmd.HasFlag("u") {
+		t.Errorf("HasFlag: F=%v u=%v, want true false", cmd.HasFlag("F"), cmd.HasFlag("u"))
+	}
+	if value, ok := cmd.Flag("o"); !ok || value != "mountpoint=/b" {
+		t.Errorf("Flag(o) = %q, %v, want the last value", value, ok)
+	}
+	if value, ok := cmd.Flag("x"); !ok || value != "compression" {
+		t.Errorf("Flag(x) = %q, %v, want compression", value, ok)
+	}
+	if cmd.Properties["mountpoint"] != "/b" {
+		t.Errorf("Properties[mountpoint] = %q, want /b", cmd.Properties["mountpoint"])
+	}
+}
+
+func TestNilCommand(t *testing.T) {
+	var cmd *Command
+	if cmd.HasFlag("s") {
+		t.Error("HasFlag on nil = true, want false")
+	}
+	if value, ok := cmd.Flag("o"); ok || value != "" {
+		t.Errorf("Flag on nil = %q, %v, want none", value, ok)
+	}
+	if target, ok := cmd.Target(); ok {
+		t.Errorf("Target on nil = %+v, want none", target)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want uint64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"512B", 512},
+		{"16K", 16 << 10},
+		{"16k", 16 << 10},
+		{"1048576KB", 1 << 30},
+		{"10G", 10 << 30},
+		{"10GiB", 10 << 30},
+		{"10 gb", 10 << 30},
+		{"1.5T", 3 << 39},
+		{"0.5M", 512 << 10},
+		{"2P", 2 << 50},
+		{"15E", 15 << 60},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.size)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %v", tt.size, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+
+	for _, size := range []string{"", "G", "-1G", "10X", "10BB", "10BiB", "10GG", "1.2.3G", "16E", "99999999999999999999"} {
+		if got, err := ParseSize(size); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want error", size, got)
+		}
+	}
+}
+
+func TestTargetPool(t *testing.T) {
+	for name, want := range map[string]string{
+		"tank":             "tank",
+		"tank/a/b":         "tank",
+		"tank/a@snap":      "tank",
+		"tank#mark":        "tank",
+		"tank/a@x,y%z":     "tank",
+		"pool1/volume-1_1": "pool1",
+	} {
+		if got := ParseTarget(name).Pool(); got != want {
+			t.Errorf("ParseTarget(%q).Pool() = %q, want %q", name, got, want)
+		}
+	}
+}